@@ -2,6 +2,9 @@ var c, ctx;
 var canvasWidth, canvasHeight;
 var iteration;
 var colors;
+var simulationID;
+var stream, latestFrame;
+var frameHistory;
 
 function drawRec(x, y, w, h, color) {
     ctx.beginPath();
@@ -17,15 +20,73 @@ function drawAgent(x, y, color) {
     ctx.fill();
 }
 
+function drawLine(x1, y1, x2, y2, color) {
+    ctx.beginPath();
+    ctx.moveTo(x1, y1);
+    ctx.lineTo(x2, y2);
+    ctx.strokeStyle = color;
+    ctx.stroke();
+}
+
+// Food is a square growing with its resource, hidden food is grey
+// and food taken by an agent is outlined in that agent's color.
+function drawFood(food, x, y, byID) {
+    let size = 4 + food.Food.Resource * 3
+    let color = food.Food.Hidden ? "grey" : "yellow"
+    drawRec(x - size / 2, y - size / 2, size, size, color)
+    let owner = byID[food.Food.Owner]
+    if (owner) {
+        ctx.strokeStyle = colors[owner.Agent.Rank % 7]
+        ctx.strokeRect(x - size / 2, y - size / 2, size, size)
+    }
+}
+
+// Agents are colored by rank, dead ones are grey, stressed ones have
+// a red ring. The line shows where they are heading, grooming is drawn
+// as a green and aggression as a red line to the other agent.
+function drawAgentState(agent, x, y, byID) {
+    let state = agent.Agent
+    drawAgent(x, y, state.Alive ? colors[state.Rank % 7] : "grey")
+    if (!state.Alive) {
+        return
+    }
+    if (state.Stressed) {
+        ctx.beginPath();
+        ctx.arc(x, y, 7, 0, 2 * Math.PI, false);
+        ctx.strokeStyle = "red";
+        ctx.stroke();
+    }
+    // the model steps x with the sine and y with the cosine of the direction
+    let angle = state.Direction * Math.PI / 180
+    drawLine(x, y, x + Math.sin(angle) * 10, y + Math.cos(angle) * 10, "white")
+    let groomed = byID[state.GroomTarget]
+    if (groomed) {
+        drawLine(x, y, groomed.X * 5, groomed.Y * 5, "lime")
+    }
+    let attacked = byID[state.AggressionTarget]
+    if (attacked) {
+        drawLine(x, y, attacked.X * 5, attacked.Y * 5, "red")
+    }
+}
+
 function drawAgents(agents) {
-    for (i = 0; i < agents.Num; i++){
-        x = agents.Agents[i].X * 5
-        y = agents.Agents[i].Y * 5
-        if (agents.Agents[i].ID == -1) {
-            agents.Agents[i].ID += 1
+    for (let wall of agents.Walls || []) {
+        drawLine(wall.X1 * 5, wall.Y1 * 5, wall.X2 * 5, wall.Y2 * 5, "#c8c8c8")
+    }
+    let byID = {}
+    for (let agent of agents.Agents) {
+        if (agent.Kind == "agent") {
+            byID[agent.ID] = agent
+        }
+    }
+    for (let agent of agents.Agents) {
+        let x = agent.X * 5
+        let y = agent.Y * 5
+        if (agent.Kind == "food") {
+            drawFood(agent, x, y, byID)
+        } else if (agent.Kind == "agent") {
+            drawAgentState(agent, x, y, byID)
         }
-        color = colors[agents.Agents[i].ID % 7]
-        drawAgent(x, y, color)
     }
 }
 
@@ -35,15 +96,30 @@ function setup() {
     canvasWidth = c.width;
     canvasHeight = c.height;
     iteration = 0;
-    colors = ["yellow", "red", "blue", "green", "violet", "orange", "cyan"]
+    colors = ["white", "red", "blue", "green", "violet", "orange", "cyan"]
     drawRec(0, 0, canvasWidth, canvasHeight, "#2b2828");
 
+    closeHistory()
+    // End the previous simulation, the server would otherwise
+    // keep it until it times out
+    if (stream) {
+        stream.close()
+        stream = undefined
+    }
+    if (simulationID) {
+        fetch("/simulation/" + simulationID, {method: "DELETE"})
+        simulationID = undefined
+    }
+
     // Start simulation and get initial positions and draw them
     let payload = {
         NumAgents: 6,
         World: "Static",
         BondedAgents: "[]",
         DSImode: "Fixed",
+        Scheduler: "parallel",
+        // wait for the Start button
+        Paused: true,
     };
     fetch("/simulation", {
         headers: {
@@ -54,9 +130,18 @@ function setup() {
         body: JSON.stringify(payload)
     }).then((response) => {
         response.text().then(function (data) {
+            if (!response.ok) {
+                // invalid parameters, the server tells what is wrong
+                console.log(data)
+                return
+            }
             let result = JSON.parse(data)
             console.log(result)
+            simulationID = result.ID
             drawAgents(result)
+            button = document.getElementById("start/stop");
+            button.innerHTML = "Start";
+            button.onclick = startSim ;
         });
     }).catch((error) => {
         console.log(error)
@@ -65,66 +150,135 @@ function setup() {
 }
 
 function startSim() {
+    closeHistory()
     // change button to Pause and change onclick event
     button = document.getElementById("start/stop");
-    button.innerHTML = "Stop";
+    button.innerHTML = "Pause";
+    button.onclick = stopSim ;
+    openStream()
+    sendCommand({Command: "resume"})
+}
+
+async function stopSim(){
+    button = document.getElementById("start/stop");
+    button.innerHTML = "Resume";
+    button.onclick = resumeSim ;
+    await sendCommand({Command: "pause"})
+    loadHistory()
+}
+
+function resumeSim(){
+    sendCommand({Command: "resume"})
+    closeHistory()
+    button = document.getElementById("start/stop");
+    button.innerHTML = "Pause";
     button.onclick = stopSim ;
-    // Start the animation frame after pressing start button
-    window.requestAnimationFrame(moveDot)
 }
 
-function stopSim(){
+async function stepSim(){
+    openStream()
+    button = document.getElementById("start/stop");
+    button.innerHTML = "Resume";
+    button.onclick = resumeSim ;
+    await sendCommand({Command: "step", Ticks: 1})
+    loadHistory()
+}
+
+// While paused the slider scrubs through the frames the server kept.
+async function loadHistory() {
     try {
-        let response = fetch("/simulation", {
+        let response = await fetch("/simulation/" + simulationID + "/frames", {
             headers: {
                 'Accept': 'application/json'
             },
-            method: "PUT"
+            method: "GET"
             });
+        frameHistory = await response.json()
     } catch(e) {
         console.log(e)
+        return
     }
+    let scrub = document.getElementById("scrub")
+    scrub.min = frameHistory.First
+    scrub.max = frameHistory.Last
+    scrub.value = frameHistory.Last
+    scrub.disabled = frameHistory.Frames.length == 0
 }
 
-// This function moves the dot down and to the right in each frame.
-async function moveDot() {
-
-    while (true) {
-        // get agents
-        let agents = await fetch_agents()
+function closeHistory() {
+    frameHistory = undefined
+    document.getElementById("scrub").disabled = true
+}
 
-        if (agents.Finished) {
-            console.log("Simulation ended")
-            return
-        }
-        
-        // Clear the canvas so we can draw on it again.
+function scrubTo() {
+    if (!frameHistory) {
+        return
+    }
+    let iteration = parseInt(document.getElementById("scrub").value)
+    let frame = frameHistory.Frames.find((frame) => frame.Iteration == iteration)
+    if (frame) {
         drawRec(0, 0, canvasWidth, canvasHeight, "#2b2828");
-
-        // Draw the agents.
-        drawAgents(agents)
-
-        iteration += 1;
-        await sleep()
+        drawAgents(frame)
     }
 }
 
-function sleep() { 
-    return new Promise(function(resolve, reject) {
-        resolve(requestAnimationFrame)
-    }); 
+function endSim(){
+    sendCommand({Command: "stop"})
+}
+
+function setSpeed(){
+    let speed = parseFloat(document.getElementById("speed").value)
+    sendCommand({Command: "speed", TicksPerSecond: speed || 0})
 }
 
-async function fetch_agents() {
+// Sends a command to the simulation and returns its resulting state
+async function sendCommand(command) {
     try {
-        let response = await fetch("/simulation", {
+        let response = await fetch("/simulation/" + simulationID, {
             headers: {
-                'Accept': 'application/json'
+                'Accept': 'application/json',
+                'Content-Type': 'application/json'
             },
-            method: "GET"
+            method: "PUT",
+            body: JSON.stringify(command)
             });
-        return await response.json();
+        let status = await response.json()
+        console.log(status)
+        return status
     } catch(e) {
         console.log(e)
     }
-}
\ No newline at end of file
+}
+
+// Frames are pushed by the server as fast as the simulation runs,
+// only the latest one is drawn on every animation frame.
+function openStream() {
+    if (stream) {
+        return
+    }
+    stream = new EventSource("/simulation/" + simulationID + "/stream")
+    stream.onmessage = function (event) {
+        let frame = JSON.parse(event.data)
+        if (frame.Finished) {
+            console.log("Simulation ended")
+            stream.close()
+            stream = undefined
+            return
+        }
+        if (!latestFrame) {
+            window.requestAnimationFrame(drawFrame)
+        }
+        latestFrame = frame
+    }
+}
+
+function drawFrame() {
+    // Clear the canvas so we can draw on it again.
+    drawRec(0, 0, canvasWidth, canvasHeight, "#2b2828");
+
+    // Draw the agents.
+    drawAgents(latestFrame)
+    latestFrame = undefined
+
+    iteration += 1;
+}
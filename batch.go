@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+	"github.com/Kubiuks/Alife_web/web_model"
+)
+
+// Design lists the levels of every experimental factor, the batch
+// runs Replicates runs of every combination (full factorial).
+// Empty factors take the same default as the web interface.
+// A World named in Schedules runs that schedule instead of a preset.
+type Design struct {
+	World             []string
+	BondedAgents      []string
+	DSImode           []string
+	CortisolThreshold []string
+	NumAgents         []int
+	Scheduler         []string
+	Border            []string
+	Collision         []string
+	Access            []web_model.FoodAccess
+	Replicates        int
+	Iterations        int
+	Seed              int64 // seeds of the runs are drawn from it, 0 picks one from the clock
+
+	Schedules map[string]web_model.Schedule
+
+	// the same walls, obstacles and food models are used in every run
+	Walls     []web_model.Segment
+	Obstacles []web_model.Polygon
+	Food      []web_model.FoodModel
+
+	// physiology and event recording of every run, see Parameters
+	RecordFormat    string
+	RecordEvery     int
+	RecordEvents    bool
+	RecordBinary    bool
+	RenderFinal     bool
+	RecordOccupancy bool
+}
+
+// run is a single simulation of the batch.
+type run struct {
+	Run       int
+	Replicate int
+	Params    Parameters
+}
+
+// RunResult is written for every run of a batch.
+type RunResult struct {
+	Run         int
+	Replicate   int
+	Params      Parameters
+	Termination string
+	Error       string `json:",omitempty"`
+	Iterations  int
+	Runtime     string
+	Agents      []AgentResult
+}
+
+// AgentResult is the state of an agent at the end of a run.
+type AgentResult struct {
+	ID           int
+	Rank         int
+	Alive        bool
+	Energy       float64
+	Cortisol     float64
+	Oxytocin     float64
+	Socialness   float64
+	Stressed     bool
+	BondPartners []int
+	DSIstrengths []float64
+}
+
+func readDesign(path string) (Design, error) {
+	var d Design
+	f, err := os.Open(path)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&d); err != nil {
+		return d, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(d.World) == 0 {
+		return d, errors.New("design needs at least one World")
+	}
+	d.setDefaults()
+	return d, nil
+}
+
+func (d *Design) setDefaults() {
+	if len(d.BondedAgents) == 0 {
+		d.BondedAgents = []string{"[]"}
+	}
+	if len(d.DSImode) == 0 {
+		d.DSImode = []string{"Fixed"}
+	}
+	if len(d.CortisolThreshold) == 0 {
+		d.CortisolThreshold = []string{"Neutral"}
+	}
+	if len(d.NumAgents) == 0 {
+		d.NumAgents = []int{6}
+	}
+	if len(d.Scheduler) == 0 {
+		d.Scheduler = []string{"parallel"}
+	}
+	if len(d.Border) == 0 {
+		d.Border = []string{"aperiodic"}
+	}
+	if len(d.Collision) == 0 {
+		d.Collision = []string{"reject"}
+	}
+	if len(d.Access) == 0 {
+		d.Access = []web_model.FoodAccess{{}}
+	}
+	if d.Replicates < 1 {
+		d.Replicates = 1
+	}
+	if d.Seed == 0 {
+		d.Seed = time.Now().UnixNano()
+	}
+}
+
+// runs expands the design into every combination of factor levels
+// times the replicates. Seeds are drawn in order from the design seed,
+// so the same design file always gives the same runs.
+func (d Design) runs() []run {
+	seeds := web_lib.NewSource(d.Seed)
+	var runs []run
+	for _, world := range d.World {
+		for _, bonded := range d.BondedAgents {
+			for _, dsi := range d.DSImode {
+				for _, threshold := range d.CortisolThreshold {
+					for _, numAgents := range d.NumAgents {
+						for _, scheduler := range d.Scheduler {
+							for _, border := range d.Border {
+								for _, collision := range d.Collision {
+									for _, access := range d.Access {
+										for rep := 0; rep < d.Replicates; rep++ {
+											seed := seeds.Int63()
+											for seed == 0 {
+												seed = seeds.Int63()
+											}
+											runs = append(runs, run{
+												Run:       len(runs),
+												Replicate: rep,
+												Params: Parameters{
+													NumAgents:         numAgents,
+													World:             world,
+													Schedule:          d.schedule(world),
+													BondedAgents:      bonded,
+													DSImode:           dsi,
+													CortisolThreshold: threshold,
+													Scheduler:         scheduler,
+													Border:            border,
+													Collision:         collision,
+													Access:            access,
+													Walls:             d.Walls,
+													Obstacles:         d.Obstacles,
+													Food:              d.Food,
+													Iterations:        d.Iterations,
+													Seed:              seed,
+													RecordFormat:      d.RecordFormat,
+													RecordEvery:       d.RecordEvery,
+													RecordEvents:      d.RecordEvents,
+													RecordBinary:      d.RecordBinary,
+													RenderFinal:       d.RenderFinal,
+													RecordOccupancy:   d.RecordOccupancy,
+												},
+											})
+										}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return runs
+}
+
+// schedule returns the schedule of world, nil for the presets.
+func (d Design) schedule(world string) *web_model.Schedule {
+	schedule, ok := d.Schedules[world]
+	if !ok {
+		return nil
+	}
+	if schedule.Name == "" {
+		schedule.Name = world
+	}
+	return &schedule
+}
+
+// runBatch runs every run of the design on workers goroutines and writes
+// one JSON file per run and a summary.csv into out. Cancelling ctx stops
+// the runs in progress, results of finished runs are kept.
+func runBatch(ctx context.Context, d Design, out string, workers int) error {
+	d.setDefaults()
+	if err := os.MkdirAll(filepath.Join(out, "runs"), 0755); err != nil {
+		return err
+	}
+	// the design with its seed is all that is needed to repeat the batch
+	designFile, err := os.Create(filepath.Join(out, "design.json"))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(designFile)
+	enc.SetIndent("", " ")
+	err = enc.Encode(d)
+	designFile.Close()
+	if err != nil {
+		return err
+	}
+
+	runs := d.runs()
+	results := make([]RunResult, len(runs))
+	jobs := make(chan run)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				res := runHeadless(ctx, r, out)
+				results[r.Run] = res
+				if err := writeRunResult(out, res); err != nil {
+					log.Printf("run %d: %v", r.Run, err)
+				}
+				log.Printf("run %d/%d: %s", r.Run+1, len(runs), res.Termination)
+			}
+		}()
+	}
+	for _, r := range runs {
+		select {
+		case jobs <- r:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := writeSummary(filepath.Join(out, "summary.csv"), results); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// runHeadless runs r without UI, its recordings go to out/runs/<run>.
+func runHeadless(ctx context.Context, r run, out string) RunResult {
+	res := RunResult{Run: r.Run, Replicate: r.Replicate, Params: r.Params}
+	start := time.Now()
+	a, err := newSim(r.Params, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	outs, err := openOutputs(a, r.Params, filepath.Join(out, "runs", fmt.Sprintf("%05d", r.Run)), "", 0)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	outs.attach(a)
+	reason, err := a.StartSimulation(ctx)
+	outs.close(a, reason)
+	res.Termination = reason.String()
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.Iterations = a.Ticks()
+	res.Runtime = time.Since(start).String()
+	for _, e := range web_model.NewSnapshot(a).Agents() {
+		result := AgentResult{
+			ID:         e.ID,
+			Rank:       e.Agent.Rank,
+			Alive:      e.Agent.Alive,
+			Energy:     e.Agent.Energy,
+			Cortisol:   e.Agent.Cortisol,
+			Oxytocin:   e.Agent.Oxytocin,
+			Socialness: e.Agent.Socialness,
+			Stressed:   e.Agent.Stressed,
+		}
+		for id := range e.Agent.DSI {
+			result.BondPartners = append(result.BondPartners, id)
+		}
+		sort.Ints(result.BondPartners)
+		for _, id := range result.BondPartners {
+			result.DSIstrengths = append(result.DSIstrengths, e.Agent.DSI[id])
+		}
+		res.Agents = append(res.Agents, result)
+	}
+	return res
+}
+
+func writeRunResult(out string, res RunResult) error {
+	f, err := os.Create(filepath.Join(out, "runs", fmt.Sprintf("%05d.json", res.Run)))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", " ")
+	if err := enc.Encode(res); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeSummary writes one row per run with the population means at the
+// end of the run. Runs that never started (batch cancelled) are left out.
+func writeSummary(path string, results []RunResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"run", "replicate", "world", "bonded_agents", "dsi_mode", "cortisol_threshold",
+		"num_agents", "scheduler", "border", "collision", "access", "seed", "termination", "error", "iterations",
+		"alive", "stressed", "mean_energy", "mean_cortisol", "mean_oxytocin", "mean_socialness"})
+	for _, res := range results {
+		if res.Termination == "" && res.Error == "" {
+			continue
+		}
+		var alive, stressed int
+		var energy, cortisol, oxytocin, socialness float64
+		for _, agent := range res.Agents {
+			if agent.Alive {
+				alive++
+			}
+			if agent.Stressed {
+				stressed++
+			}
+			energy += agent.Energy
+			cortisol += agent.Cortisol
+			oxytocin += agent.Oxytocin
+			socialness += agent.Socialness
+		}
+		mean := func(sum float64) string {
+			if len(res.Agents) == 0 {
+				return ""
+			}
+			return strconv.FormatFloat(sum/float64(len(res.Agents)), 'g', -1, 64)
+		}
+		p := res.Params
+		w.Write([]string{strconv.Itoa(res.Run), strconv.Itoa(res.Replicate), p.World, p.BondedAgents, p.DSImode,
+			p.CortisolThreshold, strconv.Itoa(p.NumAgents), p.Scheduler, p.Border, p.Collision, p.Access.String(),
+			strconv.FormatInt(p.Seed, 10), res.Termination, res.Error, strconv.Itoa(res.Iterations),
+			strconv.Itoa(alive), strconv.Itoa(stressed), mean(energy), mean(cortisol), mean(oxytocin), mean(socialness)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// batchMain is the entry point of the batch subcommand.
+func batchMain(args []string) int {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	designPath := flags.String("design", "design.json", "design file listing the factor levels")
+	out := flags.String("out", "results", "output directory")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of runs at the same time")
+	flags.Parse(args)
+
+	d, err := readDesign(*designPath)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+	log.Printf("batch of %d runs on %d workers, design seed: %d", len(d.runs()), *workers, d.Seed)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := runBatch(ctx, d, *out, *workers); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
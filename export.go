@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+	"github.com/Kubiuks/Alife_web/web_model"
+)
+
+// exportMain is the entry point of the export subcommand, it exports
+// a binary recording or a simulation it runs without UI.
+func exportMain(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	recording := flags.String("recording", "", "binary recording to export")
+	paramsPath := flags.String("params", "", "parameters of a simulation to run and export")
+	out := flags.String("out", "run.gif", "GIF file, or directory for the PNG sequence")
+	format := flags.String("format", "gif", "gif or png")
+	var options web_model.ExportOptions
+	flags.IntVar(&options.Skip, "skip", 1, "export every n-th frame")
+	flags.IntVar(&options.Scale, "scale", 5, "pixels per grid unit")
+	flags.IntVar(&options.Delay, "delay", 4, "delay between GIF frames in 100ths of a second")
+	flags.BoolVar(&options.Overlay, "overlay", true, "draw the iteration and the season")
+	flags.StringVar(&options.ColorBy, "color", "rank", "color agents by rank or stress")
+	flags.BoolVar(&options.VisionCones, "vision", false, "draw vision cones")
+	flags.Parse(args)
+
+	if err := export(*recording, *paramsPath, *out, *format, options); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+func export(recording, paramsPath, out, format string, options web_model.ExportOptions) error {
+	if (recording == "") == (paramsPath == "") {
+		return errors.New("export needs either -recording or -params")
+	}
+	if err := web_model.CheckRenderOptions(options.RenderOptions); err != nil {
+		return err
+	}
+	var exporter *web_model.Exporter
+	switch format {
+	case "gif":
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		exporter = web_model.NewGIFExporter(f, options)
+	case "png":
+		if err := os.MkdirAll(out, 0755); err != nil {
+			return err
+		}
+		exporter = web_model.NewPNGExporter(out, options)
+	default:
+		return errors.New("format must be one of: gif, png")
+	}
+
+	var err error
+	if recording != "" {
+		err = exportRecording(recording, exporter)
+	} else {
+		err = exportSimulation(paramsPath, exporter)
+	}
+	if err != nil {
+		return err
+	}
+	if err := exporter.Close(); err != nil {
+		return err
+	}
+	log.Printf("exported %d frames to %s", exporter.Frames(), out)
+	return nil
+}
+
+func exportRecording(path string, exporter *web_model.Exporter) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := web_model.NewRecordingReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		snapshot, _, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		exporter.Add(snapshot)
+	}
+}
+
+func exportSimulation(path string, exporter *web_model.Exporter) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	var params Parameters
+	err = json.NewDecoder(f).Decode(&params)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	a, err := newSim(params, nil)
+	if err != nil {
+		return err
+	}
+	a.AddReportFunc(func(a *web_lib.ABM) {
+		exporter.Add(web_model.NewSnapshot(a))
+	})
+	exporter.Add(web_model.NewSnapshot(a))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	reason, err := a.StartSimulation(ctx)
+	log.Printf("simulation ended: %s", reason)
+	return err
+}
+
+// exportHandler serves the frames kept from iteration from to iteration
+// to as an animated GIF, the other query parameters are the options.
+func exportHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	var options web_model.ExportOptions
+	var err error
+	if options.RenderOptions, err = renderOptions(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options.Overlay = true
+	if v := query.Get("overlay"); v != "" {
+		if options.Overlay, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "overlay must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	first, last, _ := s.out.history.Bounds()
+	for name, value := range map[string]*int{"skip": &options.Skip, "delay": &options.Delay,
+		"from": &first, "to": &last} {
+		if err := queryInt(query, name, value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	snapshots := s.out.history.Range(first, last)
+	if len(snapshots) == 0 {
+		http.Error(w, "no frames kept in that range", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	exporter := web_model.NewGIFExporter(w, options)
+	for _, snapshot := range snapshots {
+		exporter.Add(snapshot)
+	}
+	if err := exporter.Close(); err != nil {
+		log.Printf("export: %v", err)
+	}
+}
+
+// renderOptions reads the scale, color and vision query parameters.
+func renderOptions(query url.Values) (web_model.RenderOptions, error) {
+	options := web_model.RenderOptions{ColorBy: query.Get("color")}
+	if err := queryInt(query, "scale", &options.Scale); err != nil {
+		return options, err
+	}
+	if v := query.Get("vision"); v != "" {
+		vision, err := strconv.ParseBool(v)
+		if err != nil {
+			return options, errors.New("vision must be true or false")
+		}
+		options.VisionCones = vision
+	}
+	return options, web_model.CheckRenderOptions(options)
+}
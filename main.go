@@ -3,52 +3,116 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"image/png"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Kubiuks/Alife_web/web_lib"
+	"github.com/Kubiuks/Alife_web/web_model"
 )
 
-var tpl = template.Must(template.ParseFiles("index.html"))
+// parsed when the server starts, the batch subcommand does not need it
+var tpl *template.Template
 
-type Agent struct {
-	ID   int
-	X, Y float64
+// All_agents is the frame the UI draws, Agents are
+// the entities of the snapshot of Iteration.
+type All_agents struct {
+	ID        string
+	Iteration int
+	Agents    []web_model.Entity
+	Walls     []web_model.Segment
+	Num       int
+	Finished  bool
 }
 
-type All_agents struct {
-	Agents   []Agent
-	Num      int
-	Finished bool
+// Command is sent by the frontend to control a running simulation,
+// Command is one of pause, resume, step, stop or speed.
+type Command struct {
+	Command        string
+	Ticks          int
+	TicksPerSecond float64
 }
 
+// Parameters configure a new simulation, the zero value of a field
+// picks its default.
 type Parameters struct {
 	NumAgents                    int
 	World, BondedAgents, DSImode string
+	Schedule                     *web_model.Schedule   // changes the food over time, World then only names it
+	Seed                         int64                 // 0 picks one from the clock
+	Scheduler                    string                // parallel, sequential or random
+	Border                       string                // aperiodic (walls around the world) or periodic
+	Collision                    string                // a move into a wall: reject, reflect or slide
+	Walls                        []web_model.Segment   // inside the world, block movement and sight
+	Obstacles                    []web_model.Polygon   // like Walls
+	Food                         []web_model.FoodModel // per food source, see setupWorld
+	Access                       web_model.FoodAccess  // who eats from the food sources
+	CortisolThreshold            string                // defaults to Neutral
+	Iterations                   int                   // defaults to 15000
+	RecordFormat                 string                // csv or jsonl physiology in the data directory
+	RecordEvery                  int                   // iterations between records
+	RecordEvents                 bool                  // the interactions between agents
+	RecordBinary                 bool                  // the whole run, for Replay
+	RenderFinal                  bool                  // the final state as frame.png
+	RecordOccupancy              bool                  // occupancy.json, heatmap and trajectories
+	TicksPerSecond               float64               // web speed limit, 0 picks defaultTicksPerSecond
+	Paused                       bool                  // wait for a resume command
+	History                      int                   // recent frames kept, 0 picks defaultHistory
+	CheckpointEvery              int                   // iterations between checkpoints, 0 saves none
+	Restore                      string                // id of a checkpointed simulation to continue, only RecordFormat to CheckpointEvery still apply
+	Replay                       string                // id of a binary recording to play back instead
 }
 
-var chGrid chan []web_lib.Agent
-var chComm chan string
+var sessions = newSessionManager()
 
-func receive_agents_from_sim() All_agents {
-	var data All_agents
-	agents := <-chGrid
-	data.Finished = false
-	if agents == nil {
-		data.Finished = true
+func newFrame(id string, snapshot *web_model.Snapshot) All_agents {
+	return All_agents{
+		ID:        id,
+		Iteration: snapshot.Iteration,
+		Agents:    snapshot.Entities,
+		Walls:     snapshot.Walls,
+		Num:       len(snapshot.Entities),
 	}
-	data.Agents = make([]Agent, len(agents))
-	data.Num = len(agents)
-	for i := 0; i < len(agents); i++ {
-		data.Agents[i] = Agent{agents[i].ID(), agents[i].X(), agents[i].Y()}
+}
+
+// FrameRange is a range of past frames, First and Last are
+// the iterations of all frames the simulation still keeps.
+type FrameRange struct {
+	First, Last int
+	Frames      []All_agents
+}
+
+// nextFrame turns what a subscription received into a frame,
+// a closed subscription means the simulation ended.
+func nextFrame(s *session, snapshot interface{}, ok bool) All_agents {
+	if !ok {
+		return All_agents{ID: s.id, Finished: true}
 	}
-	return data
+	return newFrame(s.id, snapshot.(*web_model.Snapshot))
+}
+
+// receive_agents_from_sim returns the latest frame, or waits for
+// the first one if the simulation has not published any yet.
+func receive_agents_from_sim(s *session) All_agents {
+	sub := s.frames.Subscribe(1, web_lib.DropOldest)
+	defer sub.Unsubscribe()
+	snapshot, ok := <-sub.C
+	return nextFrame(s, snapshot, ok)
 }
 
-func comm_simulation() {
-	chComm <- "stop"
+func comm_simulation(s *session, kind web_lib.CommandKind, command Command) (web_lib.Status, error) {
+	return s.command(web_lib.Command{
+		Kind:           kind,
+		Ticks:          command.Ticks,
+		TicksPerSecond: command.TicksPerSecond,
+	})
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -61,40 +125,371 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	buf.WriteTo(w)
 }
 
+// agentsHandler serves /simulation for starting new runs and
+// /simulation/{id} for talking to an already running one.
+// What a run produced is under /simulation/{id}/{resource}.
 func agentsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		// Serve Agents positions taken from the simulation
-		data := receive_agents_from_sim()
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(data)
-		return
-	case http.MethodPost:
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/simulation"), "/")
+	resource := ""
+	if i := strings.Index(id, "/"); i >= 0 {
+		id, resource = id[:i], id[i+1:]
+	}
+	if r.Method == http.MethodPost {
+		if id != "" {
+			http.Error(w, "simulations are started on /simulation", http.StatusMethodNotAllowed)
+			return
+		}
 		// Start a new Simulation
 		var params Parameters
 		err := json.NewDecoder(r.Body).Decode(&params)
 		if err != nil {
-			fmt.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, err := sessions.start(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		chGrid = make(chan []web_lib.Agent)
-		chComm = make(chan string)
-		go runSim(params.NumAgents, params.World, params.BondedAgents, params.DSImode, chGrid, chComm)
-		data := receive_agents_from_sim()
+		data := receive_agents_from_sim(s)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(data)
+		return
+	}
+
+	if id == "" {
+		http.Error(w, "missing simulation id", http.StatusBadRequest)
+		return
+	}
+	s, ok := sessions.get(id)
+	if !ok {
+		http.Error(w, "unknown simulation "+id, http.StatusNotFound)
+		return
+	}
+	switch resource {
+	case "":
+	case "stream":
+		streamHandler(w, r, s)
+		return
+	case "events":
+		eventsHandler(w, r, s)
+		return
+	case "frames":
+		framesHandler(w, r, s)
+		return
+	case "frame.png":
+		pngHandler(w, r, s)
+		return
+	case "export.gif":
+		exportHandler(w, r, s)
+		return
+	case "heatmap":
+		heatmapHandler(w, r, s)
+		return
+	case "trajectories":
+		trajectoriesHandler(w, r, s)
+		return
+	default:
+		http.Error(w, "unknown resource "+resource, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		// Serve Agents positions taken from the simulation
+		data := receive_agents_from_sim(s)
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(data)
 		return
 	case http.MethodPut:
 		// Send command to the Simulation
-		// TODO get actual data from frontend
-		comm_simulation()
+		var command Command
+		err := json.NewDecoder(r.Body).Decode(&command)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		kind, err := web_lib.ParseCommandKind(command.Command)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := comm_simulation(s, kind, command)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+		return
+	case http.MethodDelete:
+		// End the Simulation and forget about it
+		sessions.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// streamHandler pushes the frames of a simulation as server-sent
+// events until it ends, the last frame has Finished set. Frames the
+// client is too slow for are skipped. Any number of clients can
+// watch the same simulation.
+func streamHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+	sub := s.frames.Subscribe(1, web_lib.DropOldest)
+	defer sub.Unsubscribe()
+	for {
+		select {
+		case snapshot, ok := <-sub.C:
+			payload, err := json.Marshal(nextFrame(s, snapshot, ok))
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+				return
+			}
+			flusher.Flush()
+			s.touch()
+			if !ok {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// framesHandler serves the frames kept from iteration from to
+// iteration to, by default all of them.
+func framesHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var data FrameRange
+	first, last, ok := s.out.history.Bounds()
+	if ok {
+		data.First, data.Last = first, last
+	}
+	from, to := first, last
+	query := r.URL.Query()
+	if err := queryInt(query, "from", &from); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := queryInt(query, "to", &to); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from > to {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	data.Frames = []All_agents{}
+	if ok {
+		for _, snapshot := range s.out.history.Range(from, to) {
+			data.Frames = append(data.Frames, newFrame(s.id, snapshot))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+// pngHandler renders the latest frame of a simulation, the query
+// parameters scale, color (rank or stress) and vision (cones) are
+// the render options.
+func pngHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	options, err := renderOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshot, ok := latestSnapshot(s)
+	if !ok {
+		http.Error(w, "simulation ended without frames", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_ = png.Encode(w, web_model.Render(snapshot, options))
+}
+
+// heatmapHandler serves where the agents spent their time so far. The
+// query parameter kind is population (default), stressed, unstressed
+// or agent together with the agent id, format is json (default) or
+// png drawn with scale pixels per cell.
+func heatmapHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
+	}
+	query := r.URL.Query()
+	kind := query.Get("kind")
+	if kind == "" {
+		kind = web_model.HeatmapPopulation
+	}
+	var agent, scale int
+	if err := queryInt(query, "agent", &agent); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := queryScale(query, &scale); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h, err := s.out.occupancy.Heatmap(kind, agent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch query.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(h)
+	case "png":
+		w.Header().Set("Content-Type", "image/png")
+		_ = png.Encode(w, web_model.RenderHeatmap(h, scale))
 	default:
-		// Give an error message.
+		http.Error(w, "format must be one of: json, png", http.StatusBadRequest)
 	}
 }
 
+// trajectoriesHandler serves the trajectories of all agents, or of the
+// one given by the agent query parameter, as json or drawn over the
+// latest frame as png.
+func trajectoriesHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	var agent, scale int
+	if err := queryInt(query, "agent", &agent); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := queryScale(query, &scale); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	trajectories := s.out.occupancy.Trajectories(agent)
+	switch query.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(trajectories)
+	case "png":
+		snapshot, ok := latestSnapshot(s)
+		if !ok {
+			http.Error(w, "simulation ended without frames", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_ = png.Encode(w, web_model.RenderTrajectories(snapshot, trajectories, scale))
+	default:
+		http.Error(w, "format must be one of: json, png", http.StatusBadRequest)
+	}
+}
+
+// latestSnapshot returns the latest snapshot, also once the simulation
+// ended, or waits for the first one.
+func latestSnapshot(s *session) (*web_model.Snapshot, bool) {
+	if snapshot, ok := s.frames.Latest(); ok {
+		return snapshot.(*web_model.Snapshot), true
+	}
+	sub := s.frames.Subscribe(1, web_lib.DropOldest)
+	defer sub.Unsubscribe()
+	snapshot, ok := <-sub.C
+	if !ok {
+		return nil, false
+	}
+	return snapshot.(*web_model.Snapshot), true
+}
+
+// eventsHandler serves the interaction events of a simulation,
+// filtered by the kind, agent, from and to query parameters.
+func eventsHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := eventQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.out.events.Query(query))
+}
+
+func eventQuery(values url.Values) (web_model.EventQuery, error) {
+	var q web_model.EventQuery
+	switch kind := values.Get("kind"); kind {
+	case "", web_model.EventGroom, web_model.EventAggression, web_model.EventSharedEating:
+		q.Kind = kind
+	default:
+		return q, errors.New("kind must be one of: " + web_model.EventGroom + ", " +
+			web_model.EventAggression + ", " + web_model.EventSharedEating)
+	}
+	for name, value := range map[string]*int{"agent": &q.Agent, "from": &q.From, "to": &q.To} {
+		if err := queryInt(values, name, value); err != nil {
+			return q, err
+		}
+	}
+	q.HasTo = values.Get("to") != ""
+	return q, nil
+}
+
+// queryInt sets n to the query parameter name, if it is there.
+func queryInt(values url.Values, name string, n *int) error {
+	v := values.Get(name)
+	if v == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return errors.New(name + " must be an integer")
+	}
+	*n = i
+	return nil
+}
+
+// queryScale reads the scale query parameter, bounded like
+// the scale of frame.png.
+func queryScale(values url.Values, scale *int) error {
+	if err := queryInt(values, "scale", scale); err != nil {
+		return err
+	}
+	return web_model.CheckRenderOptions(web_model.RenderOptions{Scale: *scale})
+}
+
 func main() {
+	// headless experiments: alife batch -design design.json -out results
+	if len(os.Args) > 1 && os.Args[1] == "batch" {
+		os.Exit(batchMain(os.Args[2:]))
+	}
+	// alife export -recording data/<id>/run.alrec -out run.gif
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(exportMain(os.Args[2:]))
+	}
+
+	tpl = template.Must(template.ParseFiles("index.html"))
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8443"
@@ -107,5 +502,8 @@ func main() {
 
 	mux.HandleFunc("/", indexHandler)
 	mux.HandleFunc("/simulation", agentsHandler)
+	mux.HandleFunc("/simulation/", agentsHandler)
+
+	go sessions.cleanup(time.Minute)
 	http.ListenAndServe(":"+port, mux)
 }
@@ -1,11 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image/gif"
+	"image/png"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+	"github.com/Kubiuks/Alife_web/web_model"
 )
 
 func TestResponse(t *testing.T) {
@@ -22,3 +40,842 @@ func TestResponse(t *testing.T) {
 
 	fmt.Printf("%d - %s", w.Code, w.Body.String())
 }
+
+func TestSessions(t *testing.T) {
+	start := func() string {
+		body := strings.NewReader(`{"NumAgents":6,"World":"Static","BondedAgents":"[]","DSImode":"Fixed"}`)
+		req := httptest.NewRequest(http.MethodPost, "/simulation", body)
+		w := httptest.NewRecorder()
+		agentsHandler(w, req)
+		var data All_agents
+		if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		return data.ID
+	}
+	first, second := start(), start()
+	if first == "" || first == second {
+		t.Fatalf("expected two distinct sessions, got %q and %q", first, second)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/simulation/"+first, nil)
+	w := httptest.NewRecorder()
+	agentsHandler(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/simulation/"+first, nil)
+	w = httptest.NewRecorder()
+	agentsHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("get removed session: got status %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/simulation/"+second, nil)
+	w = httptest.NewRecorder()
+	agentsHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get running session: got status %d", w.Code)
+	}
+	sessions.remove(second)
+}
+
+func TestInvalidParameters(t *testing.T) {
+	bodies := []string{
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[1,x]","DSImode":"Fixed"}`,
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[1,9]","DSImode":"Fixed"}`,
+		`{"NumAgents":6,"World":"Windy","BondedAgents":"[]","DSImode":"Fixed"}`,
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[]","DSImode":"Random"}`,
+		`{"NumAgents":1,"World":"Static","BondedAgents":"[]","DSImode":"Fixed"}`,
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[]","DSImode":"Fixed","Scheduler":"chaos"}`,
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[]","DSImode":"Fixed","Border":"spherical"}`,
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[]","DSImode":"Fixed","Collision":"bounce"}`,
+		`{"NumAgents":6,"World":"Dry","BondedAgents":"[]","DSImode":"Fixed","Schedule":{"Rules":[{"Action":"hide","Food":[4]}]}}`,
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[]","DSImode":"Fixed","Food":[{"Regrowth":"pulsed"}]}`,
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[]","DSImode":"Fixed","Food":[{"Rate":-1}]}`,
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[]","DSImode":"Fixed","Food":[{},{}]}`,
+		`{"NumAgents":6,"World":"Static","BondedAgents":"[]","DSImode":"Fixed","Access":{"Policy":"lottery"}}`,
+	}
+	for _, body := range bodies {
+		req := httptest.NewRequest(http.MethodPost, "/simulation", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		agentsHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// runFor runs a up to iteration n and returns a checkpoint of the result.
+func runFor(t *testing.T, a *web_lib.ABM, n int) []byte {
+	t.Helper()
+	a.LimitIterations(n)
+	if _, err := a.StartSimulation(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := web_model.SaveCheckpoint(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestCheckpointRoundTrip restores a checkpoint of every kind of world
+// taken at iteration at. The restored simulation saves
+// the same checkpoint and runs on the same.
+func TestCheckpointRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params Parameters
+		at     int
+	}{
+		{"seasonal", Parameters{NumAgents: 6, World: "Seasonal", BondedAgents: "[1,2]", DSImode: "Variable", Seed: 7}, 200},
+		{"periodic", Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed", Seed: 3,
+			Border: "periodic"}, 200},
+		{"obstacles", Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed", Seed: 8,
+			Collision: "reflect", Walls: []web_model.Segment{{X1: 20, Y1: 30, X2: 80, Y2: 30}},
+			Obstacles: []web_model.Polygon{{{40, 40}, {60, 40}, {60, 60}, {40, 60}}}}, 200},
+		// random toggles carry on the same
+		{"schedule", Parameters{NumAgents: 6, World: "Drought", BondedAgents: "[]", DSImode: "Fixed", Seed: 4,
+			Schedule: &web_model.Schedule{Seasons: 3, Rules: []web_model.ScheduleRule{
+				{Action: web_model.ActionToggle, Food: []int{2, 3}, Start: 20, Every: 10, Probability: 0.5}}}}, 200},
+		// food sources respawn at the same random places, one of them
+		// is waiting to grow back when the checkpoint is taken
+		{"food models", Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed", Seed: 3,
+			Food: []web_model.FoodModel{{Capacity: 0.1, Bite: 0.05, Regrowth: web_model.RegrowthPulsed, Pulse: 7,
+				Respawn: web_model.RespawnRandom, RespawnDelay: 30}}}, 600},
+		// two agents are waiting for food at the checkpoint, in order
+		{"food queue", Parameters{NumAgents: 6, World: "Static", BondedAgents: "[1,2]", DSImode: "Variable", Seed: 5,
+			Access: web_model.FoodAccess{Policy: web_model.AccessQueue, EatRadius: 3}}, 140},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := newSim(tc.params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved := runFor(t, a, tc.at)
+			restored, _, err := web_model.LoadCheckpoint(bytes.NewReader(saved))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored.Ticks() != tc.at {
+				t.Fatalf("restored at iteration %d, want %d", restored.Ticks(), tc.at)
+			}
+			var again bytes.Buffer
+			if err := web_model.SaveCheckpoint(&again, restored); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(saved, again.Bytes()) {
+				t.Fatal("checkpoint of a restored simulation differs from the original")
+			}
+			if !bytes.Equal(runFor(t, a, tc.at+800), runFor(t, restored, tc.at+800)) {
+				t.Fatal("restored simulation diverged")
+			}
+		})
+	}
+}
+
+func TestReproducibleRuns(t *testing.T) {
+	for _, scheduler := range []string{"parallel", "sequential", "random"} {
+		t.Run(scheduler, func(t *testing.T) {
+			params := Parameters{NumAgents: 6, World: "Seasonal", BondedAgents: "[1,2,3]", DSImode: "Variable",
+				Seed: 42, Scheduler: scheduler}
+			first, err := newSim(params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := newSim(params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(runFor(t, first, 3000), runFor(t, second, 3000)) {
+				t.Fatal("two runs with the same seed ended in a different state")
+			}
+
+			// continuing from a checkpoint gives the same run as not stopping at all
+			half, err := newSim(params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored, _, err := web_model.LoadCheckpoint(bytes.NewReader(runFor(t, half, 1500)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(runFor(t, first, 4000), runFor(t, restored, 4000)) {
+				t.Fatal("run continued from a checkpoint differs from the uninterrupted run")
+			}
+		})
+	}
+}
+
+func TestBatch(t *testing.T) {
+	d := Design{
+		World:        []string{"Static", "Seasonal"},
+		BondedAgents: []string{"[]", "[1,2]"},
+		DSImode:      []string{"Fixed"},
+		Replicates:   2,
+		Iterations:   50,
+		Seed:         3,
+		RecordFormat: "csv",
+		RecordEvery:  10,
+		RenderFinal:  true,
+
+		RecordOccupancy: true,
+	}
+	out := t.TempDir()
+	if err := runBatch(context.Background(), d, out, 2); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := filepath.Glob(filepath.Join(out, "runs", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 8 {
+		t.Fatalf("got %d run results, want 8", len(runs))
+	}
+	summary, err := os.ReadFile(filepath.Join(out, "summary.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(summary), "\n"); lines != 9 {
+		t.Fatalf("summary has %d lines, want header and 8 runs", lines)
+	}
+	physiology, err := os.ReadFile(filepath.Join(out, "runs", "00003", "physiology.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "iteration,id,alive,energy,cortisol,oxytocin,socialness,stressed,motivation,dsi_1,dsi_2,dsi_3,dsi_4,dsi_5,dsi_6\n"
+	if !strings.HasPrefix(string(physiology), header) {
+		t.Fatalf("unexpected physiology header in %q", physiology)
+	}
+	// 5 samples of 6 agents
+	if lines := strings.Count(string(physiology), "\n"); lines != 31 {
+		t.Fatalf("physiology has %d lines, want header and 30 samples", lines)
+	}
+	for _, name := range []string{"frame.png", "occupancy.json", "heatmap_stressed.png", "trajectories.png"} {
+		if _, err := os.Stat(filepath.Join(out, "runs", "00003", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	params := Parameters{NumAgents: 6, World: "Static", BondedAgents: "[1,2,3]", DSImode: "Variable",
+		Seed: 5, Iterations: 3000, RecordEvents: true}
+	a, err := newSim(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	out, err := openOutputs(a, params, dir, "", 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.attach(a)
+	reason, err := a.StartSimulation(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.close(a, reason)
+
+	events := out.events.Query(web_model.EventQuery{})
+	if len(events) == 0 {
+		t.Fatal("no interaction events in 3000 iterations")
+	}
+	logged, err := os.ReadFile(filepath.Join(dir, "events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(logged), "\n"); lines != len(events) {
+		t.Fatalf("events.jsonl has %d lines, want %d", lines, len(events))
+	}
+	for _, e := range events {
+		if e.Tick < 0 || e.Tick >= 3000 || e.Actor < 1 || e.Target < 1 || e.Actor == e.Target {
+			t.Fatalf("invalid event %+v", e)
+		}
+	}
+
+	q, err := eventQuery(url.Values{"kind": {"groom"}, "agent": {"2"}, "from": {"100"}, "to": {"2000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range out.events.Query(q) {
+		if e.Kind != web_model.EventGroom || (e.Actor != 2 && e.Target != 2) || e.Tick < 100 || e.Tick > 2000 {
+			t.Fatalf("event %+v does not match %+v", e, q)
+		}
+	}
+	if _, err := eventQuery(url.Values{"kind": {"dance"}}); err == nil {
+		t.Fatal("expected an error for an unknown kind")
+	}
+}
+
+func TestStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(agentsHandler))
+	defer server.Close()
+	s, err := sessions.start(Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed",
+		Iterations: 200, TicksPerSecond: 1000, Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.remove(s.id)
+
+	// two observers of the same run must both see it to the end
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- readStream(server.URL+"/simulation/"+s.id+"/stream", s.id)
+		}()
+	}
+	for s.frames.Subscribers() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := s.command(web_lib.Command{Kind: web_lib.CommandResume}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readStream reads server-sent frames until the simulation finished.
+func readStream(url, id string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		return fmt.Errorf("got content type %q", ct)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	frames := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var data All_agents
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+			return err
+		}
+		if data.ID != id {
+			return fmt.Errorf("frame of simulation %q, want %q", data.ID, id)
+		}
+		if data.Finished {
+			if frames == 0 {
+				return errors.New("stream ended without frames")
+			}
+			return nil
+		}
+		frames++
+	}
+	return fmt.Errorf("stream closed before the simulation finished: %v", scanner.Err())
+}
+
+func TestFrame(t *testing.T) {
+	a, err := newSim(Parameters{NumAgents: 4, World: "Static", BondedAgents: "[]", DSImode: "Fixed", Seed: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := newFrame("", web_model.NewSnapshot(a))
+	var agents, foods int
+	for _, e := range data.Agents {
+		switch e.Kind {
+		case "agent":
+			if e.Agent == nil || e.Food != nil || !e.Agent.Alive || e.Agent.Rank != e.ID {
+				t.Fatalf("invalid agent %+v", e)
+			}
+			agents++
+		case "food":
+			if e.Food == nil || e.Agent != nil || e.Food.Resource != 4 {
+				t.Fatalf("invalid food %+v", e)
+			}
+			foods++
+		default:
+			t.Fatalf("unknown kind %q", e.Kind)
+		}
+	}
+	if agents != 4 || foods != 4 {
+		t.Fatalf("got %d agents and %d foods, want 4 and 4", agents, foods)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	s, err := sessions.start(Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed",
+		TicksPerSecond: 1000, Paused: true, History: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.remove(s.id)
+	if _, err := s.command(web_lib.Command{Kind: web_lib.CommandStep, Ticks: 120}); err != nil {
+		t.Fatal(err)
+	}
+	for _, last, _ := s.out.history.Bounds(); last < 119; _, last, _ = s.out.history.Bounds() {
+		time.Sleep(time.Millisecond)
+	}
+	get := func(query string) (int, FrameRange) {
+		req := httptest.NewRequest(http.MethodGet, "/simulation/"+s.id+"/frames"+query, nil)
+		w := httptest.NewRecorder()
+		agentsHandler(w, req)
+		var data FrameRange
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, data
+	}
+
+	_, all := get("")
+	if all.First != 70 || all.Last != 119 || len(all.Frames) != 50 {
+		t.Fatalf("got frames %d to %d (%d), want the last 50 up to 119", all.First, all.Last, len(all.Frames))
+	}
+	_, some := get("?from=100&to=105")
+	if len(some.Frames) != 6 {
+		t.Fatalf("got %d frames, want 6", len(some.Frames))
+	}
+	for i, frame := range some.Frames {
+		if frame.Iteration != 100+i || frame.Num == 0 {
+			t.Fatalf("frame %d is iteration %d with %d entities", i, frame.Iteration, frame.Num)
+		}
+	}
+	if code, _ := get("?from=10&to=5"); code != http.StatusBadRequest {
+		t.Fatalf("got status %d for an empty range", code)
+	}
+}
+
+func TestRecording(t *testing.T) {
+	dataDir := t.TempDir()
+	os.Setenv("DATA_DIR", dataDir)
+	defer os.Unsetenv("DATA_DIR")
+
+	params := Parameters{NumAgents: 6, World: "Seasonal", BondedAgents: "[1,2]", DSImode: "Variable",
+		Seed: 11, Iterations: 300, RecordBinary: true}
+	a, err := newSim(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := openOutputs(a, params, filepath.Join(dataDir, "run"), "", 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.history = web_model.NewHistory(1000)
+	out.attach(a)
+	reason, err := a.StartSimulation(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.close(a, reason)
+
+	f, err := os.Open(recordingPath("run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := web_model.NewRecordingReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header().Seed != 11 || r.Header().Width != 99 {
+		t.Fatalf("unexpected header %+v", r.Header())
+	}
+	live := out.history.Range(-1, 300)
+	var events []web_model.Event
+	for i := 0; ; i++ {
+		snapshot, tickEvents, err := r.Next()
+		if err == io.EOF {
+			if i != len(live) {
+				t.Fatalf("recording has %d snapshots, want %d", i, len(live))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(snapshot, live[i]) {
+			t.Fatalf("snapshot %d differs from the live one", i)
+		}
+		events = append(events, tickEvents...)
+	}
+	if !reflect.DeepEqual(events, out.events.Query(web_model.EventQuery{})) {
+		t.Fatal("recorded events differ from the live ones")
+	}
+
+	// the replay goes through the same frames as the run
+	s, err := sessions.start(Parameters{Replay: "run", TicksPerSecond: 10000, Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.remove(s.id)
+	sub := s.frames.Subscribe(len(live)+1, web_lib.DropNewest)
+	if _, err := s.command(web_lib.Command{Kind: web_lib.CommandResume}); err != nil {
+		t.Fatal(err)
+	}
+	frames := 0
+	for snapshot := range sub.C {
+		if snapshot.(*web_model.Snapshot).Iteration != live[frames].Iteration {
+			t.Fatalf("replay frame %d is iteration %d", frames, snapshot.(*web_model.Snapshot).Iteration)
+		}
+		frames++
+	}
+	if frames != len(live) {
+		t.Fatalf("replay published %d frames, want %d", frames, len(live))
+	}
+}
+
+func TestRender(t *testing.T) {
+	s, err := sessions.start(Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed",
+		Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.remove(s.id)
+	req := httptest.NewRequest(http.MethodGet, "/simulation/"+s.id+"/frame.png?scale=2&color=stress&vision=true", nil)
+	w := httptest.NewRecorder()
+	agentsHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 198 || size.Y != 198 {
+		t.Fatalf("got a %v image, want 198x198", size)
+	}
+	// the food at 9, 9 is not hidden in a static world
+	if r, g, b, _ := img.At(18, 18).RGBA(); r>>8 != 0xff || g>>8 != 0xd7 || b != 0 {
+		t.Fatalf("food drawn as %x %x %x", r>>8, g>>8, b>>8)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/simulation/"+s.id+"/frame.png?color=sepia", nil)
+	w = httptest.NewRecorder()
+	agentsHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d for an unknown color", w.Code)
+	}
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	paramsPath := filepath.Join(dir, "params.json")
+	params := `{"NumAgents":6,"World":"Seasonal","BondedAgents":"[]","DSImode":"Fixed","Seed":3,"Iterations":40}`
+	if err := os.WriteFile(paramsPath, []byte(params), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := web_model.ExportOptions{Skip: 10, Overlay: true, RenderOptions: web_model.RenderOptions{Scale: 2}}
+
+	// the state before the first iteration and every 10th after it
+	out := filepath.Join(dir, "run.gif")
+	if err := export("", paramsPath, out, "gif", options); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 5 || g.Image[0].Bounds().Dx() != 198 {
+		t.Fatalf("got %d frames of %v, want 5 of 198x198", len(g.Image), g.Image[0].Bounds())
+	}
+	if g.LoopCount != 0 || g.Delay[4] != 4 {
+		t.Fatalf("loop count %d and delay %d, want 0 and 4", g.LoopCount, g.Delay[4])
+	}
+
+	frames := filepath.Join(dir, "frames")
+	if err := export("", paramsPath, frames, "png", options); err != nil {
+		t.Fatal(err)
+	}
+	pngs, err := filepath.Glob(filepath.Join(frames, "frame_*.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pngs) != 5 {
+		t.Fatalf("got %d PNG frames, want 5", len(pngs))
+	}
+	if err := export("", "", out, "gif", options); err == nil {
+		t.Fatal("expected an error without recording or parameters")
+	}
+}
+
+func TestOccupancy(t *testing.T) {
+	s, err := sessions.start(Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed",
+		Seed: 5, Iterations: 30, TicksPerSecond: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.remove(s.id)
+	sub := s.frames.Subscribe(1, web_lib.DropOldest)
+	for range sub.C {
+	}
+
+	get := func(query string, v interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/simulation/"+s.id+"/"+query, nil)
+		w := httptest.NewRecorder()
+		agentsHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", query, w.Code, w.Body)
+		}
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var population, stressed, unstressed, agent web_model.Heatmap
+	get("heatmap", &population)
+	get("heatmap?kind=stressed", &stressed)
+	get("heatmap?kind=unstressed", &unstressed)
+	get("heatmap?kind=agent&agent=2", &agent)
+	var trajectories []web_model.Trajectory
+	get("trajectories", &trajectories)
+	if len(trajectories) != 6 {
+		t.Fatalf("got %d trajectories, want 6", len(trajectories))
+	}
+	var total, points int
+	for i, n := range population.Counts {
+		if stressed.Counts[i]+unstressed.Counts[i] != n {
+			t.Fatalf("cell %d: %d stressed and %d unstressed of %d", i, stressed.Counts[i], unstressed.Counts[i], n)
+		}
+		total += n
+	}
+	for _, trajectory := range trajectories {
+		points += len(trajectory.Points)
+		if trajectory.ID == 2 && len(trajectory.Points) != 31 {
+			t.Fatalf("agent 2 has %d points, want the initial one and 30", len(trajectory.Points))
+		}
+	}
+	if total != points {
+		t.Fatalf("population heatmap counts %d, trajectories have %d points", total, points)
+	}
+	var sum int
+	for _, n := range agent.Counts {
+		sum += n
+	}
+	if sum != 31 {
+		t.Fatalf("heatmap of agent 2 counts %d, want 31", sum)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/simulation/"+s.id+"/heatmap?format=png&scale=2", nil)
+	w := httptest.NewRecorder()
+	agentsHandler(w, req)
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 2*population.Width || size.Y != 2*population.Height {
+		t.Fatalf("got a %v heatmap", size)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/simulation/"+s.id+"/heatmap?kind=agent&agent=9", nil)
+	w = httptest.NewRecorder()
+	agentsHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d for an unknown agent", w.Code)
+	}
+	for _, query := range []string{"heatmap?format=png&scale=1000", "trajectories?format=png&scale=21"} {
+		req = httptest.NewRequest(http.MethodGet, "/simulation/"+s.id+"/"+query, nil)
+		w = httptest.NewRecorder()
+		agentsHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d", query, w.Code)
+		}
+	}
+}
+
+func TestPeriodicBorder(t *testing.T) {
+	params := Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed", Seed: 3,
+		Border: "periodic"}
+	a, err := newSim(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := web_model.NewSnapshot(a); len(s.Walls) != 0 || s.Border != "periodic" {
+		t.Fatalf("periodic world has %d walls and border %q", len(s.Walls), s.Border)
+	}
+	last := map[int]web_model.Entity{}
+	var wrapped int
+	a.AddReportFunc(func(a *web_lib.ABM) {
+		s := web_model.NewSnapshot(a)
+		for _, e := range s.Agents() {
+			if e.X < 0 || e.X >= float64(s.Width) || e.Y < 0 || e.Y >= float64(s.Height) {
+				t.Fatalf("agent %d at %v, %v outside the grid", e.ID, e.X, e.Y)
+			}
+			if p, ok := last[e.ID]; ok && (math.Abs(e.X-p.X) > 50 || math.Abs(e.Y-p.Y) > 50) {
+				wrapped++
+			}
+			last[e.ID] = e
+		}
+	})
+	runFor(t, a, 3000)
+	if wrapped == 0 {
+		t.Fatal("no agent crossed the border")
+	}
+}
+
+func TestObstacles(t *testing.T) {
+	params := Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed", Seed: 8,
+		Walls:     []web_model.Segment{{X1: 20, Y1: 30, X2: 80, Y2: 30}},
+		Obstacles: []web_model.Polygon{{{40, 40}, {60, 40}, {60, 60}, {40, 60}}}}
+	a, err := newSim(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid := a.World().(*web_model.Grid)
+	if walls := len(web_model.NewSnapshot(a).Walls); walls != 9 {
+		t.Fatalf("got %d walls, want 4 around, 1 inside and 4 of the obstacle", walls)
+	}
+	last := map[int]web_model.Entity{}
+	a.AddReportFunc(func(a *web_lib.ABM) {
+		for _, e := range web_model.NewSnapshot(a).Agents() {
+			if grid.Inside(e.X, e.Y) {
+				t.Fatalf("agent %d inside the obstacle at %v, %v", e.ID, e.X, e.Y)
+			}
+			if p, ok := last[e.ID]; ok && grid.Blocked(p.X, p.Y, e.X, e.Y) {
+				t.Fatalf("agent %d went through a wall from %v, %v to %v, %v", e.ID, p.X, p.Y, e.X, e.Y)
+			}
+			last[e.ID] = e
+		}
+	})
+	runFor(t, a, 3000)
+
+	params.Obstacles = []web_model.Polygon{{{40, 40}, {60, 40}}}
+	if _, err := newSim(params, nil); err == nil {
+		t.Fatal("obstacle with 2 corners accepted")
+	}
+}
+
+// TestCollisionRules runs agents into walls, where they end up is
+// checked in web_model.
+func TestCollisionRules(t *testing.T) {
+	for _, rule := range []string{"reject", "reflect", "slide"} {
+		a, err := newSim(Parameters{NumAgents: 6, World: "Seasonal", BondedAgents: "[]", DSImode: "Fixed", Seed: 4,
+			Collision: rule, Walls: []web_model.Segment{
+				{X1: 49, Y1: 0, X2: 49, Y2: 99}, {X1: 0, Y1: 49, X2: 99, Y2: 49}}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		grid := a.World().(*web_model.Grid)
+		last := map[int]web_model.Entity{}
+		collisions := 0
+		a.AddReportFunc(func(a *web_lib.ABM) {
+			for _, e := range web_model.NewSnapshot(a).Agents() {
+				p, ok := last[e.ID]
+				if ok && e.Agent.Collided {
+					collisions++
+				}
+				if ok && grid.Blocked(p.X, p.Y, e.X, e.Y) {
+					t.Fatalf("%s: agent %d went through a wall", rule, e.ID)
+				}
+				last[e.ID] = e
+			}
+		})
+		runFor(t, a, 8000)
+		if collisions == 0 {
+			t.Fatalf("%s: no agent ran into a wall", rule)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	schedule := &web_model.Schedule{Seasons: 3, Rules: []web_model.ScheduleRule{
+		{Action: web_model.ActionHide, Food: []int{1}, Start: 10},
+		{Action: web_model.ActionToggle, Food: []int{2, 3}, Start: 20, Every: 10, Probability: 0.5},
+		{Action: web_model.ActionScale, Food: []int{0}, Start: 5, Every: 50, Repeat: 2, Value: 0.5},
+	}}
+	params := Parameters{NumAgents: 6, World: "Drought", BondedAgents: "[]", DSImode: "Fixed", Seed: 4,
+		Schedule: schedule}
+	a, err := newSim(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runFor(t, a, 150)
+	s := web_model.NewSnapshot(a)
+	if s.World != "Drought" {
+		t.Fatalf("world is %q, want the name of the schedule", s.World)
+	}
+	var foods []web_model.Entity
+	for _, e := range s.Entities {
+		if e.Food != nil {
+			foods = append(foods, e)
+		}
+	}
+	if !foods[1].Food.Hidden || foods[0].Food.Hidden {
+		t.Fatalf("hidden food sources: %v %v", foods[0].Food.Hidden, foods[1].Food.Hidden)
+	}
+	// halved twice from 4
+	if foods[0].Food.Resource > 1 {
+		t.Fatalf("food source 0 has %v, capacity is 1", foods[0].Food.Resource)
+	}
+}
+
+func TestFoodModels(t *testing.T) {
+	// a model for every food source
+	models := []web_model.FoodModel{{Capacity: 1}, {Capacity: 2}, {Capacity: 3, Regrowth: web_model.RegrowthNone}, {}}
+	params := Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed", Seed: 3, Food: models}
+	a, err := newSim(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var capacities []float64
+	for _, e := range web_model.NewSnapshot(a).Entities {
+		if e.Food != nil {
+			capacities = append(capacities, e.Food.Resource)
+		}
+	}
+	if !reflect.DeepEqual(capacities, []float64{1, 2, 3, 4}) {
+		t.Fatalf("food sources start with %v", capacities)
+	}
+
+	// one model for all of them, small ones are eaten up and grow back elsewhere
+	params.Food = []web_model.FoodModel{{Capacity: 0.5, Bite: 0.25, Rate: 0.0001,
+		Respawn: web_model.RespawnRandom, RespawnDelay: 20}}
+	if a, err = newSim(params, nil); err != nil {
+		t.Fatal(err)
+	}
+	runFor(t, a, 2000)
+	placed := map[[2]float64]bool{{9, 9}: true, {89, 89}: true, {9, 89}: true, {89, 9}: true}
+	moved := 0
+	for _, e := range web_model.NewSnapshot(a).Entities {
+		if e.Food == nil {
+			continue
+		}
+		if e.Food.Resource > 0.5 {
+			t.Fatalf("food source %d has %v, capacity is 0.5", e.ID, e.Food.Resource)
+		}
+		if !placed[[2]float64{e.X, e.Y}] {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no food source was eaten up and grew back somewhere else")
+	}
+}
+
+func TestFoodAccess(t *testing.T) {
+	params := Parameters{NumAgents: 6, World: "Static", BondedAgents: "[]", DSImode: "Fixed", Seed: 5}
+	for _, tc := range []struct {
+		access web_model.FoodAccess
+		want   web_model.FoodAccess
+	}{
+		{web_model.FoodAccess{}, web_model.FoodAccess{Policy: web_model.AccessContest, OwnerRadius: 4, EatRadius: 1,
+			Bite: web_model.BiteFull}},
+		{web_model.FoodAccess{Policy: web_model.AccessScramble, EatRadius: 2}, web_model.FoodAccess{
+			Policy: web_model.AccessScramble, OwnerRadius: 4, EatRadius: 2, Bite: web_model.BiteShared}},
+	} {
+		params.Access = tc.access
+		a, err := newSim(params, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.World().(*web_model.Grid).FoodAccess(); got != tc.want {
+			t.Errorf("%+v: grid has %+v, want %+v", tc.access, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+	"github.com/Kubiuks/Alife_web/web_model"
+)
+
+func recordingPath(name string) string {
+	return filepath.Join(dataDir(), name, recordingFile)
+}
+
+// replay plays back a binary recording one snapshot per tick.
+type replay struct {
+	file   *os.File
+	reader *web_model.RecordingReader
+	done   bool
+}
+
+// newReplay builds a simulation that plays back the recording of an
+// earlier simulation (its id) instead of running the model. It takes
+// the same commands as a live one, its speed is the playback speed.
+func newReplay(name string, chComm chan web_lib.Command) (*web_lib.ABM, *replay, error) {
+	if name != filepath.Base(name) {
+		return nil, nil, errors.New("invalid recording name " + name)
+	}
+	f, err := os.Open(recordingPath(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := web_model.NewRecordingReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	log.Printf("replaying %s, seed: %d", name, reader.Header().Seed)
+	a := web_lib.NewSimulation()
+	a.SetComm(chComm)
+	// the recording decides when it ends
+	a.LimitIterations(math.MaxInt32)
+	return a, &replay{file: f, reader: reader}, nil
+}
+
+// next publishes the next snapshot and its events to out,
+// false once the recording is over.
+func (r *replay) next(out *outputs) bool {
+	snapshot, events, err := r.reader.Next()
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("replay: %v", err)
+		}
+		return false
+	}
+	for _, e := range events {
+		out.addEvent(e)
+	}
+	out.publish(snapshot)
+	return true
+}
+
+func (r *replay) close() {
+	r.reader.Close()
+	r.file.Close()
+}
+
+// runReplay plays r back until it is over, stopped or ctx is
+// cancelled, the frames of out are closed afterwards to signal the end.
+func runReplay(ctx context.Context, a *web_lib.ABM, r *replay, out *outputs) {
+	start := time.Now()
+
+	a.AddReportFunc(func(a *web_lib.ABM) {
+		r.done = !r.next(out)
+	})
+	a.SetStopCondition(func(a *web_lib.ABM) bool {
+		return r.done
+	})
+	// the state before the first tick
+	if r.next(out) {
+		reason, err := a.StartSimulation(ctx)
+		if err != nil {
+			log.Printf("replay ended: %s: %v", reason, err)
+		} else {
+			log.Printf("replay ended: %s", reason)
+		}
+	}
+	out.frames.Close()
+	out.close(a, web_lib.TerminationLimit)
+	r.close()
+	log.Printf("runtime: %s", time.Since(start))
+}
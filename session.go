@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+	"github.com/Kubiuks/Alife_web/web_model"
+)
+
+// sessions idle for longer than this are stopped and removed
+const sessionTimeout = 10 * time.Minute
+
+// how long a command may wait for the engine to pick it up
+const commandTimeout = 5 * time.Second
+
+// speed of the web simulations unless asked otherwise, about
+// what the browser draws
+const defaultTicksPerSecond = 60
+
+// frames kept for looking back unless asked otherwise
+const defaultHistory = 1000
+
+// interaction events kept in memory for every session
+const sessionEvents = 100000
+
+// session is a single simulation run owned by one client.
+type session struct {
+	id     string
+	abm    *web_lib.ABM
+	frames *web_lib.Broadcaster
+	chComm chan web_lib.Command
+	cancel context.CancelFunc
+	out    *outputs
+
+	mx       sync.Mutex
+	lastSeen time.Time
+
+	// held while talking to the engine, separate from mx so
+	// requests for frames are not blocked by a pending command
+	commMx sync.Mutex
+	closed bool
+}
+
+func (s *session) touch() {
+	s.mx.Lock()
+	s.lastSeen = time.Now()
+	s.mx.Unlock()
+}
+
+func (s *session) idleSince() time.Time {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.lastSeen
+}
+
+// close ends the simulation, it is safe to call more than once.
+func (s *session) close() {
+	s.commMx.Lock()
+	defer s.commMx.Unlock()
+	s.closed = true
+	s.cancel()
+}
+
+// command sends c to the engine and returns the resulting status.
+func (s *session) command(c web_lib.Command) (web_lib.Status, error) {
+	s.commMx.Lock()
+	defer s.commMx.Unlock()
+	status := s.abm.Status()
+	if s.closed || status.State == web_lib.StateStopped || status.State == web_lib.StateFinished {
+		return status, nil
+	}
+	reply := make(chan web_lib.Status, 1)
+	c.Reply = reply
+	timeout := time.After(commandTimeout)
+	select {
+	case s.chComm <- c:
+	case <-timeout:
+		return status, errors.New("simulation did not accept the command in time")
+	}
+	select {
+	case status = <-reply:
+	case <-timeout:
+		return status, errors.New("simulation did not apply the command in time")
+	}
+	return status, nil
+}
+
+type sessionManager struct {
+	mx       sync.RWMutex
+	sessions map[string]*session
+}
+
+func newSessionManager() *sessionManager {
+	return &sessionManager{
+		sessions: make(map[string]*session),
+	}
+}
+
+// start builds a new simulation from params and runs it in the
+// background under a fresh session id. The error tells what is
+// wrong with params.
+func (m *sessionManager) start(params Parameters) (*session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		id:       id,
+		frames:   web_lib.NewBroadcaster(),
+		chComm:   make(chan web_lib.Command),
+		lastSeen: time.Now(),
+	}
+	var rp *replay
+	outParams := params
+	if params.Replay != "" {
+		s.abm, rp, err = newReplay(params.Replay, s.chComm)
+		// a replay records nothing of its own
+		outParams = Parameters{}
+	} else {
+		s.abm, err = newSim(params, s.chComm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if params.TicksPerSecond > 0 {
+		s.abm.SetTicksPerSecond(params.TicksPerSecond)
+	} else {
+		s.abm.SetTicksPerSecond(defaultTicksPerSecond)
+	}
+	if params.Paused {
+		s.abm.Pause()
+	}
+	s.out, err = openOutputs(s.abm, outParams, filepath.Join(dataDir(), id), checkpointPath(id), sessionEvents)
+	if err != nil {
+		if rp != nil {
+			rp.close()
+		}
+		return nil, err
+	}
+	s.out.frames = s.frames
+	if params.History > 0 {
+		s.out.history = web_model.NewHistory(params.History)
+	} else {
+		s.out.history = web_model.NewHistory(defaultHistory)
+	}
+	if s.out.occupancy == nil {
+		s.out.occupancy = web_model.NewOccupancy()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	m.mx.Lock()
+	m.sessions[id] = s
+	m.mx.Unlock()
+
+	if rp != nil {
+		go runReplay(ctx, s.abm, rp, s.out)
+	} else {
+		go runSim(ctx, s.abm, s.out)
+	}
+	log.Printf("session %s started", id)
+	return s, nil
+}
+
+func (m *sessionManager) get(id string) (*session, bool) {
+	m.mx.RLock()
+	s, ok := m.sessions[id]
+	m.mx.RUnlock()
+	if ok {
+		s.touch()
+	}
+	return s, ok
+}
+
+func (m *sessionManager) remove(id string) bool {
+	m.mx.Lock()
+	s, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mx.Unlock()
+	if ok {
+		s.close()
+		log.Printf("session %s removed", id)
+	}
+	return ok
+}
+
+// cleanup removes idle sessions every interval, it never returns.
+func (m *sessionManager) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		var idle []string
+		m.mx.RLock()
+		for id, s := range m.sessions {
+			if time.Since(s.idleSince()) > sessionTimeout {
+				idle = append(idle, id)
+			}
+		}
+		m.mx.RUnlock()
+		for _, id := range idle {
+			m.remove(id)
+		}
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.New("cannot generate session id: " + err.Error())
+	}
+	return hex.EncodeToString(b), nil
+}
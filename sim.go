@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"log"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -12,29 +16,41 @@ import (
 	"github.com/Kubiuks/Alife_web/web_model"
 )
 
-func runSim(numAg int, wD, bA, DSIm string, chGrid chan []web_lib.Agent, chComm chan string) {
-	start := time.Now()
+// newSim builds a simulation ready to be started by runSim. Invalid
+// parameters are reported as an error, never by exiting the process.
+func newSim(params Parameters, chComm chan web_lib.Command) (*web_lib.ABM, error) {
+	if params.Restore != "" {
+		return restoreSim(params.Restore, chComm)
+	}
 	//----------------------------------------------------------------------------------------------------------------------
 	//----------------------------------------------------------------------------------------------------------------------
 	//----------------------------------VARIABLES TESTED IN THE EXPERIMENT--------------------------------------------------
 	//----------------------------------------------------------------------------------------------------------------------
 	//----------------------------------------------------------------------------------------------------------------------
 	// variables tested in the experiment
-	worldDynamics := wD
-	numberOfAgents := numAg
-	bondedAgents := bonds(bA)
-	DSImode := DSIm
+	worldDynamics := params.World
+	numberOfAgents := params.NumAgents
+	bondedAgents, errBonds := bonds(params.BondedAgents)
+	if errBonds != nil {
+		return nil, errBonds
+	}
+	DSImode := params.DSImode
+	seed := params.Seed
 
-	// for now always Neutral, so 0.5 for every agent
-	cortisolThresholdCondition := "Neutral"
+	// Neutral unless asked otherwise, so 0.5 for every agent
+	cortisolThresholdCondition := params.CortisolThreshold
+	if cortisolThresholdCondition == "" {
+		cortisolThresholdCondition = "Neutral"
+	}
 	//----------------------------------------------------------------------------------------------------------------------
 	//----------------------------------------------------------------------------------------------------------------------
 	//----------------------------------------------------------------------------------------------------------------------
 	//----------------------------------------------------------------------------------------------------------------------
 	//----------------------------------------------------------------------------------------------------------------------
-	rand.Seed(time.Now().UnixNano())
-
 	iterations := 15000
+	if params.Iterations > 0 {
+		iterations = params.Iterations
+	}
 
 	// world setup
 	w, h := 99, 99
@@ -43,45 +59,372 @@ func runSim(numAg int, wD, bA, DSIm string, chGrid chan []web_lib.Agent, chComm
 	// vision in degrees and must be smaller than 90 (overall smaller than 180)
 	visionAngle := 40
 
+	// rank differences are normalised by numberOfAgents-1
+	if numberOfAgents < 2 {
+		return nil, errors.New("there must be at least 2 agents")
+	}
+	//check if correct mode
+	errDSI := checkDSImode(DSImode)
+	if errDSI != nil {
+		return nil, errDSI
+	}
+	scheduler, errScheduler := web_lib.ParseScheduler(params.Scheduler)
+	if errScheduler != nil {
+		return nil, errScheduler
+	}
+	border, errBorder := web_lib.ParseBorderRule(params.Border)
+	if errBorder != nil {
+		return nil, errBorder
+	}
+	collision, errCollision := web_lib.ParseCollisionRule(params.Collision)
+	if errCollision != nil {
+		return nil, errCollision
+	}
+
 	a := web_lib.NewSimulation()
-	grid2D := web_model.NewWorld(w, h, numberOfAgents, visionLength, visionAngle)
+	a.SetScheduler(scheduler)
+	// seed 0 keeps the clock based seed picked by the engine
+	if seed != 0 {
+		a.SetSeed(seed)
+	}
+	log.Printf("seed: %d", a.Seed())
+	grid2D := web_model.NewWorld(w, h, numberOfAgents, visionLength, visionAngle, border)
+	grid2D.SetCollisionRule(collision)
+	if err := grid2D.SetFoodAccess(params.Access); err != nil {
+		return nil, err
+	}
 	a.SetWorld(grid2D)
+	for _, wall := range params.Walls {
+		if err := grid2D.AddWall(wall.X1, wall.Y1, wall.X2, wall.Y2); err != nil {
+			return nil, err
+		}
+	}
+	for _, obstacle := range params.Obstacles {
+		if err := grid2D.AddObstacle(obstacle); err != nil {
+			return nil, err
+		}
+	}
 
 	// channel for communication with the Engine (ABM)
 	a.SetComm(chComm)
 
-	//check if correct mode
-	errDSI := checkDSImode(DSImode)
-	if errDSI != nil {
-		log.Fatal(errDSI)
-	}
-
 	// initialise agents from 1 to numOfAgents
 	for i := 1; i < numberOfAgents+1; i++ {
-		x, y := randomFloat(float64(w)), randomFloat(float64(h))
-		addAgent(x, y, i, i, numberOfAgents, a, grid2D, false, cortisolThresholdCondition, DSImode)
+		x, y := randomFloat(a.Rand(), float64(w)), randomFloat(a.Rand(), float64(h))
+		for grid2D.Inside(x, y) {
+			x, y = randomFloat(a.Rand(), float64(w)), randomFloat(a.Rand(), float64(h))
+		}
+		err := addAgent(x, y, i, i, numberOfAgents, a, grid2D, false, cortisolThresholdCondition, DSImode)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// set up bonds between agents
 	errBond := initialiseBonds(bondedAgents, numberOfAgents, a)
 	if errBond != nil {
-		log.Fatal(errBond)
+		return nil, errBond
 	}
 
 	// pick world settings
-	setupWorld(a, grid2D, worldDynamics)
+	errWorld := setupWorld(a, grid2D, worldDynamics, params.Schedule, params.Food)
+	if errWorld != nil {
+		return nil, errWorld
+	}
 
 	a.LimitIterations(iterations)
 
-	// reporting function, does something each iteration
-	// in this case updates the UI
-	a.SetReportFunc(func(a *web_lib.ABM) {
-		chGrid <- a.Agents()
-	})
+	// no point in running once every agent is dead
+	a.SetStopCondition(allAgentsDead)
+
+	return a, nil
+}
+
+// restoreSim continues a simulation from its checkpoint.
+func restoreSim(name string, chComm chan web_lib.Command) (*web_lib.ABM, error) {
+	if name != filepath.Base(name) {
+		return nil, errors.New("invalid checkpoint name " + name)
+	}
+	a, _, err := web_model.LoadCheckpointFile(checkpointPath(name))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("restored %s at iteration %d, seed: %d", name, a.Ticks(), a.Seed())
+	a.SetComm(chComm)
+	a.SetStopCondition(allAgentsDead)
+	return a, nil
+}
+
+func allAgentsDead(a *web_lib.ABM) bool {
+	return a.Count(func(agent web_lib.Agent) bool {
+		_, ok := agent.(*web_model.Agent)
+		return ok && agent.Alive()
+	}) == 0
+}
+
+// checkpointDir holds the checkpoints of every simulation,
+// named after the simulation id.
+func checkpointDir() string {
+	if dir := os.Getenv("CHECKPOINT_DIR"); dir != "" {
+		return dir
+	}
+	return "checkpoints"
+}
+
+func checkpointPath(name string) string {
+	return filepath.Join(checkpointDir(), name+".json")
+}
+
+// checkpointer saves a simulation every few iterations,
+// every 0 disables it.
+type checkpointer struct {
+	path  string
+	every int
+}
+
+func (c checkpointer) report(a *web_lib.ABM) {
+	if c.every > 0 && a.Ticks()%c.every == 0 {
+		c.save(a)
+	}
+}
+
+func (c checkpointer) save(a *web_lib.ABM) {
+	if c.every <= 0 {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		log.Printf("checkpoint: %v", err)
+		return
+	}
+	if err := web_model.SaveCheckpointFile(c.path, a); err != nil {
+		log.Printf("checkpoint: %v", err)
+	}
+}
+
+// dataDir holds what the simulations record,
+// every simulation has its own directory named after its id.
+func dataDir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "data"
+}
+
+// outputs are what a run produces besides its final state. All of
+// them but the checkpoint only see snapshots, never the live model.
+type outputs struct {
+	checkpoint   checkpointer
+	recorder     *web_model.Recorder
+	events       *web_model.EventLog
+	frames       *web_lib.Broadcaster // snapshots for the UI
+	history      *web_model.History
+	recording    *web_model.RecordingWriter
+	render       string // the final state is drawn there if set
+	occupancy    *web_model.Occupancy
+	occupancyDir string // the occupancy is written there if set
+}
+
+// recordingFile is the binary recording of a run in its data directory
+const recordingFile = "run.alrec"
+
+// openOutputs creates the outputs params ask for a, recordings go to dir.
+// The last keepEvents interaction events are kept in memory for queries.
+func openOutputs(a *web_lib.ABM, params Parameters, dir string, checkpointPath string, keepEvents int) (o *outputs, err error) {
+	o = &outputs{checkpoint: checkpointer{path: checkpointPath, every: params.CheckpointEvery}}
+	if params.RenderFinal {
+		o.render = filepath.Join(dir, "frame.png")
+	}
+	if params.RecordOccupancy {
+		o.occupancy = web_model.NewOccupancy()
+		o.occupancyDir = dir
+	}
+	defer func() {
+		if err != nil {
+			o.closeFiles()
+		}
+	}()
+	if params.RecordEvents || params.RecordFormat != "" || params.RecordBinary || params.RenderFinal || params.RecordOccupancy {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if params.RecordFormat != "" {
+		f, err := os.Create(filepath.Join(dir, "physiology."+params.RecordFormat))
+		if err != nil {
+			return nil, err
+		}
+		o.recorder, err = web_model.NewRecorder(f, params.RecordFormat, params.RecordEvery)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, err
+		}
+	}
+	if params.RecordEvents {
+		f, err := os.Create(filepath.Join(dir, "events.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+		o.events = web_model.NewEventLog(f, keepEvents)
+	} else if keepEvents > 0 {
+		o.events = web_model.NewEventLog(nil, keepEvents)
+	}
+	if params.RecordBinary {
+		snapshot := web_model.NewSnapshot(a)
+		header := web_model.RecordingHeader{
+			Seed:         a.Seed(),
+			Width:        snapshot.Width,
+			Height:       snapshot.Height,
+			VisionLength: snapshot.VisionLength,
+			VisionAngle:  snapshot.VisionAngle,
+			Walls:        snapshot.Walls,
+			Border:       snapshot.Border,
+			World:        snapshot.World,
+		}
+		if header.Params, err = json.Marshal(params); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(filepath.Join(dir, recordingFile))
+		if err != nil {
+			return nil, err
+		}
+		o.recording, err = web_model.NewRecordingWriter(f, header)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// attach adds the report functions of the outputs to a and hands
+// them the state before the first iteration. A snapshot is taken
+// once per iteration for all of them.
+func (o *outputs) attach(a *web_lib.ABM) {
+	a.AddReportFunc(o.checkpoint.report)
+	if o.recorder != nil || o.recording != nil || o.frames != nil || o.history != nil || o.occupancy != nil {
+		a.AddReportFunc(func(a *web_lib.ABM) {
+			snapshot := web_model.NewSnapshot(a)
+			if o.recorder != nil {
+				o.recorder.Record(snapshot)
+			}
+			if o.recording != nil {
+				o.recording.Record(snapshot)
+			}
+			o.publish(snapshot)
+		})
+		snapshot := web_model.NewSnapshot(a)
+		if o.recording != nil {
+			o.recording.Record(snapshot)
+		}
+		o.publish(snapshot)
+	}
+	if grid, ok := a.World().(*web_model.Grid); ok && (o.events != nil || o.recording != nil) {
+		grid.SetEventFunc(o.addEvent)
+	}
+}
+
+func (o *outputs) addEvent(e web_model.Event) {
+	if o.events != nil {
+		o.events.Add(e)
+	}
+	if o.recording != nil {
+		o.recording.AddEvent(e)
+	}
+}
+
+// publish hands snapshot to the UI and the occupancy.
+func (o *outputs) publish(snapshot *web_model.Snapshot) {
+	if o.occupancy != nil {
+		o.occupancy.Record(snapshot)
+	}
+	if o.history != nil {
+		o.history.Add(snapshot)
+	}
+	if o.frames != nil {
+		o.frames.Publish(snapshot)
+	}
+}
+
+// close finishes the outputs once the simulation ended. A run that
+// ends early leaves a last checkpoint behind so it can be continued.
+func (o *outputs) close(a *web_lib.ABM, reason web_lib.Termination) {
+	if reason == web_lib.TerminationStopped || reason == web_lib.TerminationCancelled {
+		o.checkpoint.save(a)
+	}
+	if o.render != "" {
+		if err := web_model.WritePNG(o.render, web_model.Render(web_model.NewSnapshot(a), web_model.RenderOptions{})); err != nil {
+			log.Printf("render: %v", err)
+		}
+	}
+	if o.occupancyDir != "" {
+		if err := writeOccupancy(o.occupancyDir, o.occupancy, web_model.NewSnapshot(a)); err != nil {
+			log.Printf("occupancy: %v", err)
+		}
+	}
+	o.closeFiles()
+}
+
+func (o *outputs) closeFiles() {
+	if o.recorder != nil {
+		if err := o.recorder.Close(); err != nil {
+			log.Printf("recorder: %v", err)
+		}
+	}
+	if o.events != nil {
+		if err := o.events.Close(); err != nil {
+			log.Printf("events: %v", err)
+		}
+	}
+	if o.recording != nil {
+		if err := o.recording.Close(); err != nil {
+			log.Printf("recording: %v", err)
+		}
+	}
+}
+
+// writeOccupancy writes the population heatmaps and the trajectories
+// of o as occupancy.json into dir, and draws each of them.
+func writeOccupancy(dir string, o *web_model.Occupancy, final *web_model.Snapshot) error {
+	var result struct {
+		Heatmaps     []web_model.Heatmap
+		Trajectories []web_model.Trajectory
+	}
+	for _, kind := range []string{web_model.HeatmapPopulation, web_model.HeatmapStressed, web_model.HeatmapUnstressed} {
+		h, err := o.Heatmap(kind, 0)
+		if err != nil {
+			return err
+		}
+		result.Heatmaps = append(result.Heatmaps, h)
+		if err := web_model.WritePNG(filepath.Join(dir, "heatmap_"+kind+".png"), web_model.RenderHeatmap(h, 0)); err != nil {
+			return err
+		}
+	}
+	result.Trajectories = o.Trajectories(0)
+	if err := web_model.WritePNG(filepath.Join(dir, "trajectories.png"), web_model.RenderTrajectories(final, result.Trajectories, 0)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "occupancy.json"), data, 0644)
+}
 
-	a.StartSimulation()
-	close(chGrid)
-	close(chComm)
+// runSim runs the simulation until it is finished, stopped or ctx is
+// cancelled, the frames of out are closed afterwards to signal the end.
+func runSim(ctx context.Context, a *web_lib.ABM, out *outputs) {
+	start := time.Now()
+
+	out.attach(a)
+	reason, err := a.StartSimulation(ctx)
+	out.frames.Close()
+	out.close(a, reason)
+	if err != nil {
+		log.Printf("simulation ended: %s: %v", reason, err)
+	} else {
+		log.Printf("simulation ended: %s", reason)
+	}
 
 	elapsed := time.Since(start)
 	log.Printf("runtime: %s", elapsed)
@@ -94,48 +437,85 @@ func runSim(numAg int, wD, bA, DSIm string, chGrid chan []web_lib.Agent, chComm
 //______________________________________________________________________________________________________________________
 
 func addAgent(x, y float64, id, rank, numOfAgents int, a *web_lib.ABM, grid2D *web_model.Grid,
-	trail bool, CortisolThresholdCondition, DSImode string) {
+	trail bool, CortisolThresholdCondition, DSImode string) error {
 	cell, err := web_model.NewAgent(a, id, rank, numOfAgents, x, y, trail, CortisolThresholdCondition, DSImode)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	a.AddAgent(cell)
 	grid2D.SetCell(cell.X(), cell.Y(), cell)
+	return nil
 }
 
-func addFood(x, y float64, a *web_lib.ABM, grid2D *web_model.Grid) {
+func addFood(x, y float64, a *web_lib.ABM, grid2D *web_model.Grid) (*web_model.Food, error) {
 	cell, err := web_model.NewFood(a, x, y)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	a.AddAgent(cell)
 	grid2D.SetCell(cell.X(), cell.Y(), cell)
+	return cell, nil
 }
 
-func setupWorld(a *web_lib.ABM, grid2D *web_model.Grid, condition string) {
-	err := grid2D.SetWorldDynamics(condition)
-	if err != nil {
-		log.Fatal(err)
-	}
-	switch condition {
-	case "Static":
-		addFood(9, 9, a, grid2D)
-		addFood(89, 89, a, grid2D)
-		addFood(9, 89, a, grid2D)
-		addFood(89, 9, a, grid2D)
-	case "Seasonal":
-		addFood(9, 9, a, grid2D)
-		addFood(89, 89, a, grid2D)
-		addFood(9, 89, a, grid2D)
-		addFood(89, 9, a, grid2D)
-	case "Extreme":
-		addFood(9, 9, a, grid2D)
-		addFood(89, 89, a, grid2D)
-		addFood(9, 89, a, grid2D)
-		addFood(89, 9, a, grid2D)
+// setupWorld places the food sources, the preset condition or the
+// schedule, if there is one, decide when they are available. Models
+// are one for every food source or a single one for all of them.
+func setupWorld(a *web_lib.ABM, grid2D *web_model.Grid, condition string, schedule *web_model.Schedule,
+	models []web_model.FoodModel) error {
+	if schedule == nil {
+		if err := grid2D.SetWorldDynamics(condition); err != nil {
+			return err
+		}
+	}
+	// food sources are the same in every condition,
+	// the world dynamics decide when they are available
+	foods := [][2]float64{{9, 9}, {89, 89}, {9, 89}, {89, 9}}
+	if len(models) != 0 && len(models) != 1 && len(models) != len(foods) {
+		return errors.New("there must be one food model or one for every food source (" + strconv.Itoa(len(foods)) + ")")
+	}
+	for i, pos := range foods {
+		food, err := addFood(pos[0], pos[1], a, grid2D)
+		if err != nil {
+			return err
+		}
+		if len(models) == 0 {
+			continue
+		}
+		model := models[0]
+		if len(models) > 1 {
+			model = models[i]
+		}
+		if model.Seed == 0 {
+			model.Seed = a.Seed() ^ foodSeed ^ int64(i)<<32
+		}
+		if err := food.SetModel(model); err != nil {
+			return err
+		}
+	}
+	if schedule != nil {
+		if err := schedule.Check(len(foods)); err != nil {
+			return err
+		}
+		// every run gets its own schedule, it keeps the season
+		s := *schedule
+		if s.Name == "" {
+			s.Name = condition
+		}
+		if s.Seed == 0 {
+			s.Seed = a.Seed() ^ scheduleSeed
+		}
+		grid2D.SetDynamics(&s)
 	}
+	return nil
 }
 
+// scheduleSeed and foodSeed set the random sources of schedules and
+// food sources apart from the simulation one, unless they have a seed.
+const (
+	scheduleSeed = 0x5eed
+	foodSeed     = 0xf00d
+)
+
 func initialiseBonds(bondedAgents []int, numberOfAgents int, a *web_lib.ABM) error {
 	for i := 0; i < len(bondedAgents); i++ {
 		if bondedAgents[i] < 1 || bondedAgents[i] > numberOfAgents {
@@ -165,27 +545,27 @@ func initialiseBonds(bondedAgents []int, numberOfAgents int, a *web_lib.ABM) err
 	return nil
 }
 
-func bonds(arg string) []int {
+func bonds(arg string) ([]int, error) {
 
 	temp := strings.Replace(arg, "[", "", -1)
 	temp2 := strings.Replace(temp, "]", "", -1)
 
 	t := strings.Split(temp2, ",")
 
-	if t[0] == "" {
-		return nil
+	if strings.TrimSpace(t[0]) == "" && len(t) == 1 {
+		return nil, nil
 	}
 
 	var t2 []int
 
 	for _, i := range t {
-		j, err := strconv.Atoi(i)
+		j, err := strconv.Atoi(strings.TrimSpace(i))
 		if err != nil {
-			log.Fatal(err)
+			return nil, errors.New("bonded agents must be a list of agent ids like [1,2], got " + arg)
 		}
 		t2 = append(t2, j)
 	}
-	return t2
+	return t2, nil
 }
 
 func checkDSImode(DSImode string) error {
@@ -196,10 +576,10 @@ func checkDSImode(DSImode string) error {
 }
 
 // needed to make sure it's never 0
-func randomFloat(max float64) float64 {
+func randomFloat(rng *rand.Rand, max float64) float64 {
 	var res float64
 	for {
-		res = rand.Float64()
+		res = rng.Float64()
 		if res != 0 {
 			break
 		}
@@ -12,6 +12,18 @@ type Agent interface {
 	Run()
 }
 
+// PhasedAgent splits Run in two so that all agents can be updated in
+// parallel without seeing each other's changes. Sense may only change
+// the agent itself and has to queue every change to anything shared
+// (other agents, the world), Act applies the queued changes. The
+// ParallelScheduler runs Sense of every agent concurrently, then Act
+// one agent at a time in a fixed order.
+type PhasedAgent interface {
+	Agent
+	Sense()
+	Act()
+}
+
 func CopyAgent(src Agent) Agent {
 	if src == nil {
 		return nil
@@ -0,0 +1,142 @@
+package web_lib
+
+import "sync"
+
+// DropPolicy decides which frame a subscriber loses when
+// its buffer is full.
+type DropPolicy int
+
+const (
+	DropOldest DropPolicy = iota // keep the most recent frames
+	DropNewest                   // keep the frames already buffered
+)
+
+// Broadcaster hands every published frame to all of its subscribers.
+// Publishing never blocks, a slow subscriber loses frames according
+// to its drop policy without slowing down the simulation or the
+// other subscribers.
+type Broadcaster struct {
+	mx       sync.Mutex
+	subs     map[*Subscription]struct{}
+	latest   interface{}
+	isLatest bool
+	closed   bool
+}
+
+// Subscription receives frames on C until it is unsubscribed
+// or the broadcaster is closed, then C is closed.
+type Subscription struct {
+	C       <-chan interface{}
+	ch      chan interface{}
+	policy  DropPolicy
+	dropped int
+	b       *Broadcaster
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe attaches a new subscriber buffering up to buffer frames.
+// It starts with the latest frame, so it does not have to wait for
+// the next tick to know the current state.
+func (b *Broadcaster) Subscribe(buffer int, policy DropPolicy) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	ch := make(chan interface{}, buffer)
+	s := &Subscription{C: ch, ch: ch, policy: policy, b: b}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		close(ch)
+		return s
+	}
+	if b.isLatest {
+		ch <- b.latest
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Publish sends frame to every subscriber.
+func (b *Broadcaster) Publish(frame interface{}) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return
+	}
+	b.latest, b.isLatest = frame, true
+	for s := range b.subs {
+		s.send(frame)
+	}
+}
+
+// send is called with b.mx held, so nobody else sends on s.ch.
+func (s *Subscription) send(frame interface{}) {
+	select {
+	case s.ch <- frame:
+		return
+	default:
+	}
+	s.dropped++
+	if s.policy == DropNewest {
+		return
+	}
+	select {
+	case <-s.ch:
+	default:
+	}
+	select {
+	case s.ch <- frame:
+	default:
+	}
+}
+
+// Latest returns the last published frame, false if there was none.
+func (b *Broadcaster) Latest() (interface{}, bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.latest, b.isLatest
+}
+
+func (b *Broadcaster) Subscribers() int {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return len(b.subs)
+}
+
+// Close closes every subscription, later subscriptions are closed
+// right away. Once the simulation ended nothing is published anymore.
+func (b *Broadcaster) Close() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for s := range b.subs {
+		close(s.ch)
+	}
+	b.subs = nil
+}
+
+// Unsubscribe detaches s and closes C, it is safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	b := s.b
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+// Dropped returns how many frames s lost because its buffer was full.
+func (s *Subscription) Dropped() int {
+	s.b.mx.Lock()
+	defer s.b.mx.Unlock()
+	return s.dropped
+}
@@ -0,0 +1,96 @@
+package web_lib
+
+import (
+	"errors"
+	"strings"
+)
+
+// CommandKind tells the engine what to do with a Command.
+type CommandKind uint8
+
+const (
+	CommandPause  CommandKind = iota // stop ticking until resumed or stepped
+	CommandResume                    // continue ticking
+	CommandStep                      // pause and run Ticks more ticks
+	CommandStop                      // end the simulation
+	CommandSpeed                     // limit the engine to TicksPerSecond
+)
+
+var commandNames = []string{"pause", "resume", "step", "stop", "speed"}
+
+func (k CommandKind) String() string {
+	if int(k) < len(commandNames) {
+		return commandNames[k]
+	}
+	return "unknown"
+}
+
+// ParseCommandKind is the inverse of CommandKind.String.
+func ParseCommandKind(name string) (CommandKind, error) {
+	for i, n := range commandNames {
+		if strings.EqualFold(n, name) {
+			return CommandKind(i), nil
+		}
+	}
+	return 0, errors.New("command must be one of: " + strings.Join(commandNames, ", "))
+}
+
+// Command is sent to the engine through the channel given to SetComm.
+// If Reply is set the engine sends its Status there once the command
+// is applied, so it should be buffered.
+type Command struct {
+	Kind           CommandKind
+	Ticks          int     // used by CommandStep, at least 1
+	TicksPerSecond float64 // used by CommandSpeed, 0 means no limit
+	Reply          chan<- Status
+}
+
+// State of the engine loop.
+type State uint8
+
+const (
+	StateRunning State = iota
+	StatePaused
+	StateStopped  // ended by CommandStop or a closed comm channel
+	StateFinished // ran until the iteration limit
+)
+
+var stateNames = []string{"running", "paused", "stopped", "finished"}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return "unknown"
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Status is a summary of the engine state.
+type Status struct {
+	State          State
+	Iteration      int
+	StepsLeft      int
+	TicksPerSecond float64
+}
+
+// Termination tells why StartSimulation returned.
+type Termination uint8
+
+const (
+	TerminationLimit     Termination = iota // iteration limit reached
+	TerminationStopped                      // CommandStop or closed comm channel
+	TerminationCondition                    // stop condition met
+	TerminationCancelled                    // context cancelled
+)
+
+var terminationNames = []string{"limit reached", "stopped", "stop condition met", "cancelled"}
+
+func (t Termination) String() string {
+	if int(t) < len(terminationNames) {
+		return terminationNames[t]
+	}
+	return "unknown"
+}
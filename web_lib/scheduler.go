@@ -0,0 +1,102 @@
+package web_lib
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Scheduler activates the agents once per iteration, it decides
+// in which order they run and what they see of each other.
+type Scheduler interface {
+	Step(a *ABM, agents []Agent)
+	String() string
+}
+
+// ParallelScheduler updates all agents synchronously. Phased agents
+// sense concurrently on the world as it was at the start of the
+// iteration, then everything is applied in the order agents were
+// added, so the outcome does not depend on goroutine scheduling.
+// Agents that are not phased just run in that order.
+type ParallelScheduler struct{}
+
+func (ParallelScheduler) Step(a *ABM, agents []Agent) {
+	var wg sync.WaitGroup
+	for _, agent := range agents {
+		if phased, ok := agent.(PhasedAgent); ok {
+			wg.Add(1)
+			go func(agent PhasedAgent) {
+				agent.Sense()
+				wg.Done()
+			}(phased)
+		}
+	}
+	wg.Wait()
+	for _, agent := range agents {
+		if phased, ok := agent.(PhasedAgent); ok {
+			phased.Act()
+		} else {
+			agent.Run()
+		}
+	}
+}
+
+func (ParallelScheduler) String() string { return "parallel" }
+
+// SequentialScheduler runs agents one after another in ascending ID
+// order, each one sees what the agents before it did. Entities without
+// an agent ID (below 1) run afterwards in the order they were added.
+type SequentialScheduler struct{}
+
+func (SequentialScheduler) Step(a *ABM, agents []Agent) {
+	ordered := make([]Agent, len(agents))
+	copy(ordered, agents)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		idI, idJ := ordered[i].ID(), ordered[j].ID()
+		if idI < 1 || idJ < 1 {
+			return idI >= 1 && idJ < 1
+		}
+		return idI < idJ
+	})
+	for _, agent := range ordered {
+		agent.Run()
+	}
+}
+
+func (SequentialScheduler) String() string { return "sequential" }
+
+// RandomScheduler runs agents one after another in an order reshuffled
+// every iteration with the simulation random source.
+type RandomScheduler struct{}
+
+func (RandomScheduler) Step(a *ABM, agents []Agent) {
+	ordered := make([]Agent, len(agents))
+	copy(ordered, agents)
+	a.Rand().Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	for _, agent := range ordered {
+		agent.Run()
+	}
+}
+
+func (RandomScheduler) String() string { return "random" }
+
+var schedulers = []Scheduler{ParallelScheduler{}, SequentialScheduler{}, RandomScheduler{}}
+
+// ParseScheduler returns the built-in scheduler with the given name,
+// an empty name is the default parallel scheduler.
+func ParseScheduler(name string) (Scheduler, error) {
+	if name == "" {
+		return ParallelScheduler{}, nil
+	}
+	var names []string
+	for _, s := range schedulers {
+		if strings.EqualFold(s.String(), name) {
+			return s, nil
+		}
+		names = append(names, s.String())
+	}
+	return nil, errors.New("scheduler must be one of: " + strings.Join(names, ", "))
+}
@@ -1,7 +1,10 @@
 package web_lib
 
 import (
+	"context"
+	"math/rand"
 	"sync"
+	"time"
 )
 
 type ABM struct {
@@ -9,19 +12,73 @@ type ABM struct {
 	agents []Agent
 
 	i     int // current iteration
+	ticks int // iterations already run
 	limit int
 
-	world      World
-	reportFunc func(*ABM)
-	chComm     chan string
+	world       World
+	scheduler   Scheduler
+	reportFuncs []func(*ABM)
+	stopFunc    func(*ABM) bool
+	chComm      chan Command
+
+	state    State
+	steps    int     // ticks left to run while paused
+	tps      float64 // ticks per second limit, 0 means none
+	lastTick time.Time
+
+	seed int64
+	src  *Source
+	rng  *rand.Rand
 }
 
 // New creates new ABM simulation engine with default
-// parameters.
+// parameters. The random source is seeded from the clock,
+// use SetSeed for a reproducible run.
 func NewSimulation() *ABM {
-	return &ABM{
-		limit: 1000,
+	a := &ABM{
+		limit:     1000,
+		scheduler: ParallelScheduler{},
 	}
+	a.SetSeed(time.Now().UnixNano())
+	return a
+}
+
+// SetSeed resets the simulation random source. All randomness
+// in a run (spawn positions, agent decisions) must be drawn from
+// Rand so that two runs with the same seed are identical.
+func (a *ABM) SetSeed(seed int64) {
+	a.mx.Lock()
+	a.seed = seed
+	a.src = NewSource(seed)
+	a.rng = rand.New(a.src)
+	a.mx.Unlock()
+}
+
+func (a *ABM) Seed() int64 {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.seed
+}
+
+// RandState returns the state of the simulation random source,
+// together with Ticks it is what a checkpoint needs to continue a run.
+func (a *ABM) RandState() uint64 {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.src.State()
+}
+
+func (a *ABM) SetRandState(state uint64) {
+	a.mx.Lock()
+	a.src.SetState(state)
+	a.mx.Unlock()
+}
+
+// Rand returns the simulation random source. It is not safe for
+// concurrent use, agents running in parallel should derive their
+// own source from it when they are created.
+func (a *ABM) Rand() *rand.Rand {
+	return a.rng
 }
 
 func (a *ABM) SetWorld(w World) {
@@ -30,7 +87,7 @@ func (a *ABM) SetWorld(w World) {
 	}
 }
 
-func (a *ABM) SetComm(c chan string) {
+func (a *ABM) SetComm(c chan Command) {
 	if a.chComm == nil {
 		a.chComm = c
 	}
@@ -40,8 +97,36 @@ func (a *ABM) World() World {
 	return a.world
 }
 
+// SetScheduler chooses how agents are activated every iteration,
+// by default a ParallelScheduler.
+func (a *ABM) SetScheduler(s Scheduler) {
+	a.mx.Lock()
+	a.scheduler = s
+	a.mx.Unlock()
+}
+
+func (a *ABM) Scheduler() Scheduler {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.scheduler
+}
+
+// SetReportFunc sets the function called after every iteration,
+// replacing all report functions set before.
 func (a *ABM) SetReportFunc(fn func(*ABM)) {
-	a.reportFunc = fn
+	a.reportFuncs = []func(*ABM){fn}
+}
+
+// AddReportFunc adds a function called after every iteration,
+// report functions are called in the order they were added.
+func (a *ABM) AddReportFunc(fn func(*ABM)) {
+	a.reportFuncs = append(a.reportFuncs, fn)
+}
+
+// SetStopCondition sets a function checked after every iteration,
+// the simulation ends as soon as it returns true.
+func (a *ABM) SetStopCondition(fn func(*ABM) bool) {
+	a.stopFunc = fn
 }
 
 func (a *ABM) AddAgent(agent Agent) {
@@ -69,6 +154,25 @@ func (a *ABM) Limit() int {
 	return a.limit
 }
 
+// Ticks returns the number of iterations already run,
+// StartSimulation continues from there.
+func (a *ABM) Ticks() int {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.ticks
+}
+
+// SetTicks is used to continue a restored simulation,
+// it must not be called while the simulation is running.
+func (a *ABM) SetTicks(n int) {
+	a.mx.Lock()
+	a.ticks = n
+	if n > 0 {
+		a.i = n - 1
+	}
+	a.mx.Unlock()
+}
+
 // Iteration returns current iteration (age, generation).
 func (a *ABM) Iteration() int {
 	a.mx.RLock()
@@ -76,58 +180,179 @@ func (a *ABM) Iteration() int {
 	return a.i
 }
 
-func (a *ABM) checkComm() string {
-	select {
-	case comm, ok := <-a.chComm:
-		if ok {
-			// comm to process
-			return comm
-		} else {
-			// channel closed
-			return "closed"
+// Status returns the current state of the engine.
+func (a *ABM) Status() Status {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return Status{
+		State:          a.state,
+		Iteration:      a.i,
+		StepsLeft:      a.steps,
+		TicksPerSecond: a.tps,
+	}
+}
+
+// SetTicksPerSecond limits the speed of the simulation, 0 means
+// as fast as possible. A running simulation takes a speed command.
+func (a *ABM) SetTicksPerSecond(tps float64) {
+	a.mx.Lock()
+	if tps < 0 {
+		tps = 0
+	}
+	a.tps = tps
+	a.mx.Unlock()
+}
+
+// Pause makes StartSimulation wait for a resume or step command
+// before the first tick. A running simulation takes a pause command.
+func (a *ABM) Pause() {
+	a.mx.Lock()
+	a.state = StatePaused
+	a.steps = 0
+	a.mx.Unlock()
+}
+
+func (a *ABM) applyCommand(c Command) {
+	a.mx.Lock()
+	switch c.Kind {
+	case CommandPause:
+		a.state = StatePaused
+		a.steps = 0
+	case CommandResume:
+		a.state = StateRunning
+		a.steps = 0
+	case CommandStep:
+		a.state = StatePaused
+		if c.Ticks < 1 {
+			c.Ticks = 1
+		}
+		a.steps += c.Ticks
+	case CommandStop:
+		a.state = StateStopped
+	case CommandSpeed:
+		if c.TicksPerSecond < 0 {
+			c.TicksPerSecond = 0
 		}
-	default:
-		// no comm
-		return ""
+		a.tps = c.TicksPerSecond
+	}
+	a.mx.Unlock()
+	if c.Reply != nil {
+		c.Reply <- a.Status()
 	}
 }
 
-func (a *ABM) waitForComm() {
-	<-a.chComm
+func (a *ABM) stop() {
+	a.finish(StateStopped)
 }
 
-func (a *ABM) dealWithComm() {
-	comm := a.checkComm()
-	if comm != "" {
-		if comm == "stop" {
-			a.waitForComm()
+// dealWithComm applies every pending command and reports whether
+// the next tick should run. While paused it blocks until a command
+// allows the engine to continue or ctx is done. Closing the comm
+// channel ends the simulation.
+func (a *ABM) dealWithComm(ctx context.Context) bool {
+	for pending := true; pending; {
+		select {
+		case c, ok := <-a.chComm:
+			if !ok {
+				a.stop()
+				return false
+			}
+			a.applyCommand(c)
+		default:
+			pending = false
+		}
+	}
+	for {
+		status := a.Status()
+		switch {
+		case status.State == StateStopped:
+			return false
+		case status.State == StatePaused && status.StepsLeft > 0:
+			a.mx.Lock()
+			a.steps--
+			a.mx.Unlock()
+			return true
+		case status.State != StatePaused:
+			return true
+		}
+		select {
+		case c, ok := <-a.chComm:
+			if !ok {
+				a.stop()
+				return false
+			}
+			a.applyCommand(c)
+		case <-ctx.Done():
+			return false
 		}
 	}
 }
 
-func (a *ABM) StartSimulation() {
-	for i := 0; i < a.Limit(); i++ {
-		a.dealWithComm()
+// pace sleeps so that ticks are not faster than the speed limit.
+func (a *ABM) pace(ctx context.Context) {
+	a.mx.RLock()
+	tps := a.tps
+	a.mx.RUnlock()
+	if tps > 0 {
+		next := a.lastTick.Add(time.Duration(float64(time.Second) / tps))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	a.lastTick = time.Now()
+}
 
+// StartSimulation runs the simulation until the iteration limit, a stop
+// command, the stop condition or until ctx is done, and tells which one
+// it was. The error is only set when ctx ended the simulation.
+func (a *ABM) StartSimulation(ctx context.Context) (Termination, error) {
+	for i := a.Ticks(); i < a.Limit(); i++ {
+		if !a.dealWithComm(ctx) {
+			if ctx.Err() != nil {
+				break
+			}
+			return TerminationStopped, nil
+		}
+		a.pace(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+
+		a.mx.Lock()
 		a.i = i
+		a.mx.Unlock()
 		if a.World() != nil {
 			a.World().Tick(a.agents)
 		}
 		//fmt.Printf("%v\n", i)
-		var wg sync.WaitGroup
-		for j := 0; j < a.AgentsCount(); j++ {
-			wg.Add(1)
-			go func(wg *sync.WaitGroup, i, j int) {
-				a.agents[j].Run()
-				wg.Done()
-			}(&wg, i, j)
-		}
-		wg.Wait()
+		a.Scheduler().Step(a, a.Agents())
+		a.mx.Lock()
+		a.ticks = i + 1
+		a.mx.Unlock()
 
-		if a.reportFunc != nil {
-			a.reportFunc(a)
+		for _, report := range a.reportFuncs {
+			report(a)
 		}
+		if a.stopFunc != nil && a.stopFunc(a) {
+			a.finish(StateFinished)
+			return TerminationCondition, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		a.stop()
+		return TerminationCancelled, err
 	}
+	a.finish(StateFinished)
+	return TerminationLimit, nil
+}
+
+func (a *ABM) finish(state State) {
+	a.mx.Lock()
+	a.state = state
+	a.mx.Unlock()
 }
 
 func (a *ABM) AgentsCount() int {
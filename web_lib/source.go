@@ -0,0 +1,29 @@
+package web_lib
+
+// Source is a splitmix64 random source. Unlike the sources from
+// math/rand its whole state is a single number, so it can be saved
+// with a checkpoint and restored to continue the exact same sequence.
+// Like those sources it is not safe for concurrent use.
+type Source struct {
+	state uint64
+}
+
+func NewSource(seed int64) *Source {
+	return &Source{state: uint64(seed)}
+}
+
+func (s *Source) Seed(seed int64) { s.state = uint64(seed) }
+
+func (s *Source) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *Source) Int63() int64 { return int64(s.Uint64() >> 1) }
+
+func (s *Source) State() uint64 { return s.state }
+
+func (s *Source) SetState(state uint64) { s.state = state }
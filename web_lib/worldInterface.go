@@ -1,5 +1,10 @@
 package web_lib
 
+import (
+	"errors"
+	"strings"
+)
+
 type World interface {
 	Tick([]Agent) // mark the beginning of the next time period
 }
@@ -12,3 +17,61 @@ const (
 	BorderPeriodic  BorderRule = iota // wrap around the other side
 	BorderAPeriodic                   // hit the wall
 )
+
+func (b BorderRule) String() string {
+	switch b {
+	case BorderPeriodic:
+		return "periodic"
+	case BorderAPeriodic:
+		return "aperiodic"
+	}
+	return "unknown"
+}
+
+// ParseBorderRule returns the border rule with the given name,
+// an empty name is the default aperiodic border with walls.
+func ParseBorderRule(name string) (BorderRule, error) {
+	switch strings.ToLower(name) {
+	case "", "aperiodic":
+		return BorderAPeriodic, nil
+	case "periodic":
+		return BorderPeriodic, nil
+	}
+	return BorderAPeriodic, errors.New("border must be one of: aperiodic, periodic")
+}
+
+// CollisionRule represents rule of what happens when a move
+// of an agent runs into a wall.
+type CollisionRule uint8
+
+const (
+	CollisionReject  CollisionRule = iota // stay where it was
+	CollisionReflect                      // bounce off the wall
+	CollisionSlide                        // move along the wall
+)
+
+func (c CollisionRule) String() string {
+	switch c {
+	case CollisionReject:
+		return "reject"
+	case CollisionReflect:
+		return "reflect"
+	case CollisionSlide:
+		return "slide"
+	}
+	return "unknown"
+}
+
+// ParseCollisionRule returns the collision rule with the given
+// name, an empty name is the default that rejects the move.
+func ParseCollisionRule(name string) (CollisionRule, error) {
+	switch strings.ToLower(name) {
+	case "", "reject":
+		return CollisionReject, nil
+	case "reflect":
+		return CollisionReflect, nil
+	case "slide":
+		return CollisionSlide, nil
+	}
+	return CollisionReject, errors.New("collision must be one of: reject, reflect, slide")
+}
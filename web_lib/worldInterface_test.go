@@ -0,0 +1,31 @@
+package web_lib
+
+import "testing"
+
+func TestParseBorderRule(t *testing.T) {
+	for _, rule := range []BorderRule{BorderPeriodic, BorderAPeriodic} {
+		if got, err := ParseBorderRule(rule.String()); err != nil || got != rule {
+			t.Errorf("%s: parsed as %v, %v", rule, got, err)
+		}
+	}
+	if got, err := ParseBorderRule(""); err != nil || got != BorderAPeriodic {
+		t.Errorf("empty border parsed as %v, %v", got, err)
+	}
+	if _, err := ParseBorderRule("spherical"); err == nil {
+		t.Error("unknown border parsed")
+	}
+}
+
+func TestParseCollisionRule(t *testing.T) {
+	for _, rule := range []CollisionRule{CollisionReject, CollisionReflect, CollisionSlide} {
+		if got, err := ParseCollisionRule(rule.String()); err != nil || got != rule {
+			t.Errorf("%s: parsed as %v, %v", rule, got, err)
+		}
+	}
+	if got, err := ParseCollisionRule(""); err != nil || got != CollisionReject {
+		t.Errorf("empty collision parsed as %v, %v", got, err)
+	}
+	if _, err := ParseCollisionRule("bounce"); err == nil {
+		t.Error("unknown collision parsed")
+	}
+}
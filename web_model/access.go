@@ -0,0 +1,231 @@
+package web_model
+
+import (
+	"errors"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+)
+
+// food access policies, who owns a food source and who eats from it
+const (
+	// contest competition, the default: the highest ranked agent near
+	// the food source owns it, keeps lower ranked agents away and eats
+	AccessContest = "contest"
+	// scramble competition: nobody owns it, everyone next to it eats
+	AccessScramble = "scramble"
+	// one agent eats at a time, the others next to it wait their turn
+	// in the order they arrived
+	AccessQueue = "queue"
+	// the first agent to arrive eats and owns it until it leaves,
+	// the others next to it are sent away
+	AccessExclusive = "exclusive"
+	// only to reproduce runs from before food access policies: the owner
+	// is the last agent found near the food source, whatever its rank,
+	// and everyone next to it eats
+	AccessLegacyLastFound = "legacy-last-found"
+)
+
+// bite rules, how much an eating agent takes at once
+const (
+	BiteFull   = "full"   // the bite of the food source
+	BiteShared = "shared" // the bite split between the agents eating
+	BiteRank   = "rank"   // the bite times the rank over the highest rank eating
+)
+
+// FoodAccess is the policy of who may eat from the food sources and
+// how much. Agents within OwnerRadius compete for ownership, within
+// EatRadius they eat. The zero value is a contest with radii 4 and 1
+// and full bites, scramble shares the bites by default.
+type FoodAccess struct {
+	Policy      string  `json:",omitempty"`
+	OwnerRadius float64 `json:",omitempty"`
+	EatRadius   float64 `json:",omitempty"`
+	Bite        string  `json:",omitempty"`
+}
+
+// Check validates p and fills in the defaults.
+func (p *FoodAccess) Check() error {
+	if p.OwnerRadius < 0 || p.EatRadius < 0 {
+		return errors.New("food access radii must not be negative")
+	}
+	if p.OwnerRadius == 0 {
+		p.OwnerRadius = 4
+	}
+	if p.EatRadius == 0 {
+		p.EatRadius = 1
+	}
+	switch p.Policy {
+	case "":
+		p.Policy = AccessContest
+	case AccessContest, AccessScramble, AccessQueue, AccessExclusive, AccessLegacyLastFound:
+	default:
+		return errors.New("food access must be one of: contest, scramble, queue, exclusive, legacy-last-found")
+	}
+	switch p.Bite {
+	case "":
+		p.Bite = BiteFull
+		if p.Policy == AccessScramble {
+			p.Bite = BiteShared
+		}
+	case BiteFull, BiteShared, BiteRank:
+	default:
+		return errors.New("bite must be one of: full, shared, rank")
+	}
+	return nil
+}
+
+// String is the policy and the bite rule, the defaults filled in.
+func (p FoodAccess) String() string {
+	if err := p.Check(); err != nil {
+		return p.Policy
+	}
+	return p.Policy + "/" + p.Bite
+}
+
+// SetFoodAccess changes the food access policy, it must be
+// called before the simulation starts.
+func (g *Grid) SetFoodAccess(p FoodAccess) error {
+	if err := p.Check(); err != nil {
+		return err
+	}
+	g.access = p
+	return nil
+}
+
+func (g *Grid) FoodAccess() FoodAccess {
+	return g.access
+}
+
+// checkOccupyingFood finds the owner of food and the agents eating
+// from it at the start of an iteration.
+func (g *Grid) checkOccupyingFood(agents []web_lib.Agent, food *Food) {
+	if g.access.Policy == AccessLegacyLastFound {
+		g.checkOccupyingFoodLastFound(agents, food)
+		return
+	}
+	var owner *Agent
+	var near []*Agent
+	center := vector{food.X(), food.Y()}
+	for k := 0; k < len(agents); k++ {
+		agent, ok := agents[k].(*Agent)
+		if !ok || !agent.Alive() {
+			continue
+		}
+		point := g.nearest(center, vector{agent.X(), agent.Y()})
+		relVector := vector{point.x - center.x, point.y - center.y}
+		if isWithinRadius(relVector, g.access.OwnerRadius) && (owner == nil || agent.Rank() > owner.Rank()) {
+			owner = agent
+		}
+		if isWithinRadius(relVector, g.access.EatRadius) {
+			near = append(near, agent)
+		}
+	}
+	switch g.access.Policy {
+	case AccessContest:
+		// only the owner eats, everyone next to the food without one
+		if owner != nil {
+			var eating []*Agent
+			if containsAgent(near, owner) {
+				eating = []*Agent{owner}
+			}
+			near = eating
+		}
+		food.setAccess(owner, near)
+	case AccessScramble:
+		food.setAccess(nil, near)
+	case AccessQueue, AccessExclusive:
+		// those still there keep their place, newcomers join at the end
+		var queue []*Agent
+		for _, agent := range food.EatingAgents() {
+			if containsAgent(near, agent) {
+				queue = append(queue, agent)
+			}
+		}
+		for _, agent := range near {
+			if !containsAgent(queue, agent) {
+				queue = append(queue, agent)
+			}
+		}
+		owner = nil
+		if g.access.Policy == AccessExclusive && len(queue) > 0 {
+			owner = queue[0]
+		}
+		food.setAccess(owner, queue)
+	}
+}
+
+// checkOccupyingFoodLastFound is the rule from before food access
+// policies, highestRank is never raised so any rank above 0 wins.
+func (g *Grid) checkOccupyingFoodLastFound(agents []web_lib.Agent, food *Food) {
+	var highestRankAgent *Agent
+	highestRank := 0
+	center := vector{food.X(), food.Y()}
+	food.ResetEatingAgents()
+	for k := 0; k < len(agents); k++ {
+		if agents[k].ID() < 1 {
+			continue
+		}
+		point := g.nearest(center, vector{agents[k].X(), agents[k].Y()})
+		relVector := vector{point.x - center.x, point.y - center.y}
+		if isWithinRadius(relVector, g.access.OwnerRadius) {
+			if agents[k].(*Agent).Rank() > highestRank {
+				highestRankAgent = agents[k].(*Agent)
+			}
+			if isWithinRadius(relVector, g.access.EatRadius) {
+				food.AddEatingAgent(agents[k].(*Agent))
+			}
+		}
+	}
+	food.SetOwner(highestRankAgent)
+}
+
+func containsAgent(agents []*Agent, agent *Agent) bool {
+	for _, a := range agents {
+		if a == agent {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Food) setAccess(owner *Agent, eating []*Agent) {
+	f.mutex.Lock()
+	f.owner = owner
+	f.eatingAgents = eating
+	f.mutex.Unlock()
+}
+
+// mayEat tells whether agent, next to f, may eat from it now. In a
+// contest only the owner eats, with a queue or exclusive access only
+// the first in line.
+func (f *Food) mayEat(agent *Agent) bool {
+	switch f.grid.access.Policy {
+	case AccessContest:
+		return agent == f.owner || f.owner == nil
+	case AccessQueue, AccessExclusive:
+		return len(f.eatingAgents) > 0 && f.eatingAgents[0] == agent
+	}
+	return true
+}
+
+// biteFor is what agent takes from f at once under the bite rule.
+func (f *Food) biteFor(agent *Agent) float64 {
+	bite := f.BiteSize()
+	switch f.grid.access.Bite {
+	case BiteShared:
+		if len(f.eatingAgents) > 1 {
+			bite /= float64(len(f.eatingAgents))
+		}
+	case BiteRank:
+		highest := agent.Rank()
+		for _, other := range f.eatingAgents {
+			if other.Rank() > highest {
+				highest = other.Rank()
+			}
+		}
+		if highest > 0 {
+			bite *= float64(agent.Rank()) / float64(highest)
+		}
+	}
+	return bite
+}
@@ -0,0 +1,150 @@
+package web_model
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+)
+
+// newTestAgents places agents of the given ranks at positions, ids
+// from 1, and a food source at 9,9.
+func newTestAgents(t *testing.T, access FoodAccess, ranks []int, positions [][2]float64) (*web_lib.ABM, []*Agent, *Food) {
+	t.Helper()
+	a := web_lib.NewSimulation()
+	g := NewWorld(100, 100, len(ranks), 20, 160, web_lib.BorderAPeriodic)
+	if err := g.SetFoodAccess(access); err != nil {
+		t.Fatal(err)
+	}
+	a.SetWorld(g)
+	var agents []*Agent
+	for i, pos := range positions {
+		agent, err := NewAgent(a, i+1, ranks[i], len(ranks), pos[0], pos[1], false, "Neutral", "Fixed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.AddAgent(agent)
+		g.SetCell(agent.X(), agent.Y(), agent)
+		agents = append(agents, agent)
+	}
+	food, err := NewFood(a, 9, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AddAgent(food)
+	g.SetCell(food.X(), food.Y(), food)
+	return a, agents, food
+}
+
+func TestContestOwnerEatsAlone(t *testing.T) {
+	// the owner and a lower ranked bond partner both next to the food
+	a, agents, food := newTestAgents(t, FoodAccess{Policy: AccessContest, Bite: BiteShared}, []int{1, 2},
+		[][2]float64{{9.5, 9}, {9, 9.5}})
+	subordinate, owner := agents[0], agents[1]
+	subordinate.SetBonds([]int{owner.ID()})
+	owner.SetBonds([]int{subordinate.ID()})
+	var events []Event
+	a.World().(*Grid).SetEventFunc(func(e Event) { events = append(events, e) })
+	a.World().Tick(a.Agents())
+	if food.Owner() != owner {
+		t.Fatalf("owner %v, want the higher ranked agent", food.Owner())
+	}
+	if eating := food.EatingAgents(); len(eating) != 1 || eating[0] != owner {
+		t.Fatalf("%d agents eating, want the owner alone", len(eating))
+	}
+	subordinate.energy, owner.energy = 0.5, 0.5
+	// an agent eats every 6th time it is next to food
+	for i := 0; i < 6; i++ {
+		subordinate.findEatFood(nil, []web_lib.Agent{food}, nil)
+		owner.findEatFood(nil, []web_lib.Agent{food}, nil)
+	}
+	owner.Act()
+	if subordinate.Energy() != 0.5 || owner.Energy() != 0.5+food.BiteSize() {
+		t.Fatalf("energy of subordinate %v and owner %v", subordinate.Energy(), owner.Energy())
+	}
+	// the owner leaves full without having eaten with its partner
+	owner.energy = 1
+	owner.findEatFood(nil, []web_lib.Agent{food}, nil)
+	owner.Act()
+	if len(events) != 0 {
+		t.Fatalf("events %+v", events)
+	}
+}
+
+func TestFoodAccessOwner(t *testing.T) {
+	ids := func(agents []*Agent) []int {
+		var ids []int
+		for _, agent := range agents {
+			ids = append(ids, agent.ID())
+		}
+		return ids
+	}
+	for _, tc := range []struct {
+		policy string
+		owner  int
+		eating []int
+	}{
+		{"", 1, nil},
+		{AccessScramble, 0, []int{2, 3}},
+		{AccessQueue, 0, []int{2, 3}},
+		{AccessExclusive, 2, []int{2, 3}},
+	} {
+		// ranks 3, 2 and 1, the highest ranked is near but not next to the
+		// food and found first
+		a, _, food := newTestAgents(t, FoodAccess{Policy: tc.policy}, []int{3, 2, 1},
+			[][2]float64{{12, 9}, {9.5, 9}, {9, 9.8}})
+		a.World().Tick(a.Agents())
+		owner := 0
+		if food.Owner() != nil {
+			owner = food.Owner().ID()
+		}
+		if owner != tc.owner || !reflect.DeepEqual(ids(food.EatingAgents()), tc.eating) {
+			t.Errorf("%q: owner %d eating %v, want owner %d eating %v", tc.policy, owner,
+				ids(food.EatingAgents()), tc.owner, tc.eating)
+		}
+	}
+}
+
+func TestFoodQueueOrder(t *testing.T) {
+	for _, policy := range []string{AccessQueue, AccessExclusive} {
+		a, agents, food := newTestAgents(t, FoodAccess{Policy: policy}, []int{1, 2, 3},
+			[][2]float64{{30, 30}, {9.5, 9}, {50, 50}})
+		grid := a.World().(*Grid)
+		moveTo := func(agent *Agent, x, y float64) {
+			if err := grid.Move(agent.id, agent.x, agent.y, x, y); err != nil {
+				t.Fatal(err)
+			}
+			agent.x, agent.y = x, y
+		}
+		check := func(want ...int) {
+			t.Helper()
+			grid.Tick(a.Agents())
+			var queue []int
+			for _, agent := range food.EatingAgents() {
+				queue = append(queue, agent.id)
+			}
+			if !reflect.DeepEqual(queue, want) {
+				t.Fatalf("%s: queue %v, want %v", policy, queue, want)
+			}
+			for _, agent := range agents {
+				if first := agent.id == want[0]; food.mayEat(agent) != first {
+					t.Fatalf("%s: agent %d may eat %v", policy, agent.id, !first)
+				}
+			}
+			if owner := food.Owner(); policy == AccessExclusive && owner.id != want[0] || policy == AccessQueue && owner != nil {
+				t.Fatalf("%s: owner %v", policy, owner)
+			}
+		}
+		check(2)
+		// arrivals join at the end whatever their id or rank
+		moveTo(agents[0], 9, 9.5)
+		check(2, 1)
+		moveTo(agents[2], 8.5, 9)
+		check(2, 1, 3)
+		// the first leaves and the next one eats
+		moveTo(agents[1], 20, 20)
+		check(1, 3)
+		moveTo(agents[1], 9.5, 9)
+		check(1, 3, 2)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"math"
 	"math/rand"
 	"sync"
-	"time"
 
 	"github.com/Kubiuks/Alife_web/web_lib"
 )
@@ -39,6 +38,7 @@ type Agent struct {
 	sharedFoodWith          []int
 	groomedWith             int
 	aggressionOn            int
+	collided                bool // ran into a wall this iteration
 	eatingTogetherIntensity float64
 	stepSize                float64
 	tactileEat              float64
@@ -53,10 +53,12 @@ type Agent struct {
 	trail        bool
 	direction    float64
 	numOfAgents  int
+	src          *web_lib.Source
+	rng          *rand.Rand
+	effects      []func() // queued by Sense, applied by Act
 }
 
 func NewAgent(abm *web_lib.ABM, id, rank, numOfAgents int, x, y float64, trail bool, CortisolThresholdCondition, DSImode string) (*Agent, error) {
-	rand.Seed(time.Now().UnixNano())
 	world := abm.World()
 	if world == nil {
 		return nil, errors.New("agent needs a World defined to operate")
@@ -70,6 +72,10 @@ func NewAgent(abm *web_lib.ABM, id, rank, numOfAgents int, x, y float64, trail b
 	if err != nil {
 		return nil, err
 	}
+	// every agent gets its own source derived from the simulation one,
+	// agents run concurrently and *rand.Rand is not safe to share
+	src := web_lib.NewSource(abm.Rand().Int63())
+	rng := rand.New(src)
 	return &Agent{
 		alive:                   true,
 		energy:                  1,
@@ -106,17 +112,29 @@ func NewAgent(abm *web_lib.ABM, id, rank, numOfAgents int, x, y float64, trail b
 		y:           y,
 		grid:        grid,
 		trail:       trail,
-		direction:   rand.Float64() * 360,
+		direction:   rng.Float64() * 360,
 		numOfAgents: numOfAgents,
+		src:         src,
+		rng:         rng,
 	}, nil
 }
 
+// Run senses and acts at once, for running the agent on its own.
 func (a *Agent) Run() {
+	a.Sense()
+	a.Act()
+}
+
+// Sense decides what the agent does this iteration. It only changes
+// the agent itself, effects on other agents, food and the grid are
+// queued for Act. Implements web_lib.PhasedAgent.
+func (a *Agent) Sense() {
 	a.iteration++
 
 	// reset flags
 	a.groomedWith = 0
 	a.aggressionOn = 0
+	a.collided = false
 
 	// dont do anything if dead
 	if !a.alive {
@@ -134,8 +152,23 @@ func (a *Agent) Run() {
 		a.cortisol = 1
 		a.socialness = 0
 		a.oxytocin = 0
-		a.grid.ClearCell(a.x, a.y, a.id)
+		a.queue(func() {
+			a.grid.ClearCell(a.x, a.y, a.id)
+		})
+	}
+}
+
+// Act applies the effects queued by Sense in the order they were queued.
+// Implements web_lib.PhasedAgent.
+func (a *Agent) Act() {
+	for _, effect := range a.effects {
+		effect()
 	}
+	a.effects = a.effects[:0]
+}
+
+func (a *Agent) queue(effect func()) {
+	a.effects = append(a.effects, effect)
 }
 
 func (a *Agent) actionSelection() {
@@ -157,7 +190,7 @@ func (a *Agent) actionSelection() {
 
 	if groomMotivation > eatMotivation {
 		if a.justEaten {
-			if randBool() {
+			if a.randBool() {
 				a.move(mod(a.direction-90, 360))
 			} else {
 				a.move(mod(a.direction+90, 360))
@@ -244,7 +277,7 @@ func (a *Agent) pickAgent(agents, foods, walls []web_lib.Agent) {
 
 func (a *Agent) groomOraggressionOrAvoid(agent *Agent, foods []web_lib.Agent) {
 	agentVal := a.agentVal(agent)
-	if distance(a.x, a.y, agent.X(), agent.Y()) < 2 {
+	if a.grid.distance(a.x, a.y, agent.X(), agent.Y()) < 2 {
 		a.socialness = a.socialness + a.tactileIntensity*0.15
 		if a.stressed && a.rank > agent.Rank() && agentVal <= 1 {
 			a.aggression(agent)
@@ -257,13 +290,13 @@ func (a *Agent) groomOraggressionOrAvoid(agent *Agent, foods []web_lib.Agent) {
 			if len(foods) > 0 {
 				a.direction = mod(a.direction-180, 360)
 			} else if a.stressed {
-				if randBool() {
+				if a.randBool() {
 					a.direction = mod(a.direction-(90*1.5*a.cortisol), 360)
 				} else {
 					a.direction = mod(a.direction+(90*1.5*a.cortisol), 360)
 				}
 			} else {
-				if randBool() {
+				if a.randBool() {
 					a.direction = mod(a.direction-(90*a.cortisol), 360)
 				} else {
 					a.direction = mod(a.direction+(90*a.cortisol), 360)
@@ -276,37 +309,51 @@ func (a *Agent) groomOraggressionOrAvoid(agent *Agent, foods []web_lib.Agent) {
 func (a *Agent) groom(agent *Agent) {
 	a.groomedWith = agent.ID()
 	oxyGain := (1 - a.oxytocin) * 0.7
-	a.IncreaseOT(oxyGain)
-	agent.IncreaseOT(oxyGain)
-	agent.ModulateCT(-1 * a.tactileIntensity * 0.2)
+	tactileIntensity := a.tactileIntensity
+	e := Event{Kind: EventGroom, Actor: a.id, Target: agent.ID(), Intensity: tactileIntensity}
+	e.ActorDelta.Oxytocin = a.IncreaseOT(oxyGain)
 	if a.DSImode == "Variable" {
-		a.ModulateDSI(agent.ID(), a.tactileIntensity*0.3)
-		agent.ModulateDSI(a.id, a.tactileIntensity*0.3)
+		e.ActorDelta.DSI = a.ModulateDSI(agent.ID(), tactileIntensity*0.3)
 	}
+	a.queue(func() {
+		e.TargetDelta.Oxytocin = agent.IncreaseOT(oxyGain)
+		e.TargetDelta.Cortisol = agent.ModulateCT(-1 * tactileIntensity * 0.2)
+		if a.DSImode == "Variable" {
+			e.TargetDelta.DSI = agent.ModulateDSI(a.id, tactileIntensity*0.3)
+		}
+		a.grid.emit(e)
+	})
 	a.randomMove()
 }
 
 func (a *Agent) aggression(agent *Agent) {
 	a.aggressionOn = agent.ID()
-	a.ModulateCT(-1 * a.tactileIntensity * 0.15)
-	agent.ModulateCT(a.tactileIntensity * 0.15)
+	tactileIntensity := a.tactileIntensity
+	e := Event{Kind: EventAggression, Actor: a.id, Target: agent.ID(), Intensity: tactileIntensity}
+	e.ActorDelta.Cortisol = a.ModulateCT(-1 * tactileIntensity * 0.15)
 	if a.DSImode == "Variable" {
-		a.ModulateDSI(agent.ID(), -1*a.tactileIntensity*0.15)
-		agent.ModulateDSI(a.id, -1*a.tactileIntensity*0.15)
+		e.ActorDelta.DSI = a.ModulateDSI(agent.ID(), -1*tactileIntensity*0.15)
 	}
+	a.queue(func() {
+		e.TargetDelta.Cortisol = agent.ModulateCT(tactileIntensity * 0.15)
+		if a.DSImode == "Variable" {
+			e.TargetDelta.DSI = agent.ModulateDSI(a.id, -1*tactileIntensity*0.15)
+		}
+		a.grid.emit(e)
+	})
 	a.randomMove()
 }
 
 func (a *Agent) avoidAgent() {
 	if a.stressed {
-		if randBool() {
+		if a.randBool() {
 			a.move(mod(a.direction-(90*1.5*a.cortisol), 360))
 		} else {
 			a.move(mod(a.direction+(90*1.5*a.cortisol), 360))
 
 		}
 	} else {
-		if randBool() {
+		if a.randBool() {
 			a.move(mod(a.direction-(90*a.cortisol), 360))
 		} else {
 			a.move(mod(a.direction+(90*a.cortisol), 360))
@@ -323,7 +370,7 @@ func (a *Agent) findEatFood(agents, foods, walls []web_lib.Agent) {
 		for _, temp := range agents {
 			tmpAgentVal := a.agentVal(temp.(*Agent))
 			if tmpAgentVal < 0 && a.stressed {
-				if randBool() {
+				if a.randBool() {
 					a.move(mod(a.direction-(90*1.5*a.cortisol), 360))
 				} else {
 					a.move(mod(a.direction+(90*1.5*a.cortisol), 360))
@@ -345,7 +392,7 @@ func (a *Agent) findEatFood(agents, foods, walls []web_lib.Agent) {
 				}
 			} else {
 				// higher ranked agents but not stressed
-				if randBool() {
+				if a.randBool() {
 					a.move(mod(a.direction-(90*a.cortisol), 360))
 				} else {
 					a.move(mod(a.direction+(90*a.cortisol), 360))
@@ -358,19 +405,21 @@ func (a *Agent) findEatFood(agents, foods, walls []web_lib.Agent) {
 		var food web_lib.Agent
 		dist := 100.0
 		for _, temp := range foods {
-			tmpDist := distance(a.x, a.y, temp.X(), temp.Y())
+			tmpDist := a.grid.distance(a.x, a.y, temp.X(), temp.Y())
 			if tmpDist < dist {
 				food = temp
 				dist = tmpDist
 			}
 		}
-		if dist <= 1 {
+		if dist <= a.grid.access.EatRadius && !food.(*Food).mayEat(a) {
+			a.waitForFood()
+		} else if dist <= a.grid.access.EatRadius {
 			// next to food, so can eat
 			a.eatFood(food.(*Food))
 			a.justEaten = true
 			a.checkEatenWithBondPartner(food.(*Food))
 			if a.energy >= 1 {
-				if randBool() {
+				if a.randBool() {
 					a.move(mod(a.direction-90, 360))
 				} else {
 					a.move(mod(a.direction+90, 360))
@@ -392,8 +441,12 @@ func (a *Agent) eatFood(f *Food) {
 	if a.foodTimeWaiting < 5 {
 		a.foodTimeWaiting++
 	} else {
-		f.reduceResource(0.01)
-		a.energy += 0.01
+		// the energy comes from what is left once the agents
+		// before this one took their bites
+		bite := f.biteFor(a)
+		a.queue(func() {
+			a.energy = math.Min(a.energy+f.reduceResource(bite), 1)
+		})
 		a.foodTimeWaiting++
 	}
 	if a.foodTimeWaiting >= 6 {
@@ -401,8 +454,17 @@ func (a *Agent) eatFood(f *Food) {
 	}
 }
 
+// waitForFood is what an agent next to food that it may not eat
+// from does, it waits its turn in a queue or leaves otherwise.
+func (a *Agent) waitForFood() {
+	if a.grid.access.Policy == AccessQueue {
+		return
+	}
+	a.move(mod(a.direction-180, 360))
+}
+
 func (a *Agent) turnFromWall() {
-	a.direction = mod(a.direction+rand.Float64()*135-rand.Float64()*135, 360)
+	a.direction = mod(a.direction+a.rng.Float64()*135-a.rng.Float64()*135, 360)
 }
 
 func (a *Agent) approachOrAvoid(f *Food) {
@@ -421,13 +483,18 @@ func (a *Agent) approachOrAvoid(f *Food) {
 }
 
 func (a *Agent) moveTo(agent web_lib.Agent) {
-	a.move(math.Atan2(agent.X()-a.x, agent.Y()-a.y) * (180.0 / math.Pi))
+	target := a.grid.nearest(vector{a.x, a.y}, vector{agent.X(), agent.Y()})
+	a.move(math.Atan2(target.x-a.x, target.y-a.y) * (180.0 / math.Pi))
 }
 
 func (a *Agent) randomMove() {
-	a.move(mod(a.direction+rand.Float64()*20-rand.Float64()*20, 360))
+	a.move(mod(a.direction+a.rng.Float64()*20-a.rng.Float64()*20, 360))
 }
 
+// move turns the agent and steps forward, the position only changes
+// in Act so other agents keep seeing where it was during Sense. Running
+// into a wall sets collided, what happens then is up to the collision
+// rule of the grid.
 func (a *Agent) move(direction float64) {
 	oldx, oldy := a.x, a.y
 	oldDirection := a.direction
@@ -437,20 +504,29 @@ func (a *Agent) move(direction float64) {
 	} else {
 		a.stepSize = 0.5 + a.cortisol*0.75
 	}
-	a.x = oldx + a.stepSize*math.Sin(a.direction*(math.Pi/180.0))
-	a.y = oldy + a.stepSize*math.Cos(a.direction*(math.Pi/180.0))
+	x := oldx + a.stepSize*math.Sin(a.direction*(math.Pi/180.0))
+	y := oldy + a.stepSize*math.Cos(a.direction*(math.Pi/180.0))
+	x, y = a.grid.wrap(x, y)
 
-	var err error
-	if a.trail {
-		err = a.grid.Copy(a.id, oldx, oldy, a.x, a.y)
-	} else {
-		err = a.grid.Move(a.id, oldx, oldy, a.x, a.y)
-	}
-
-	if err != nil {
-		a.x, a.y = oldx, oldy
-		a.direction = oldDirection
+	if a.grid.validateXY(x, y) != nil || a.grid.Blocked(oldx, oldy, x, y) {
+		a.collided = true
+		var ok bool
+		if x, y, a.direction, ok = a.grid.deflect(oldx, oldy, x, y, a.direction); !ok {
+			a.direction = oldDirection
+			return
+		}
 	}
+	a.queue(func() {
+		var err error
+		if a.trail {
+			err = a.grid.Copy(a.id, oldx, oldy, x, y)
+		} else {
+			err = a.grid.Move(a.id, oldx, oldy, x, y)
+		}
+		if err == nil {
+			a.x, a.y = x, y
+		}
+	})
 }
 
 func (a *Agent) checkEatenWithBondPartner(food *Food) {
@@ -471,11 +547,16 @@ func (a *Agent) sharedEatingFood() {
 		return
 	}
 	oxyGain := 2 - (2*a.oxytocin)*0.2
-	a.IncreaseOT(oxyGain)
-	if a.DSImode == "Variable" {
-		for _, id := range a.sharedFoodWith {
-			a.ModulateDSI(id, a.tactileEat*0.3)
+	gained := a.IncreaseOT(oxyGain)
+	for _, id := range a.sharedFoodWith {
+		e := Event{Kind: EventSharedEating, Actor: a.id, Target: id, Intensity: a.tactileEat}
+		e.ActorDelta.Oxytocin = gained
+		if a.DSImode == "Variable" {
+			e.ActorDelta.DSI = a.ModulateDSI(id, a.tactileEat*0.3)
 		}
+		a.queue(func() {
+			a.grid.emit(e)
+		})
 	}
 }
 
@@ -674,24 +755,29 @@ func (a *Agent) SetBonds(bonds []int) {
 	}
 }
 
-func (a *Agent) ModulateDSI(id int, amount float64) {
+// ModulateDSI, ModulateCT and IncreaseOT return the actual change.
+func (a *Agent) ModulateDSI(id int, amount float64) float64 {
 	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	for i, partnerID := range a.bondPartners {
 		if id == partnerID {
+			old := a.DSIstrengths[i]
 			a.DSIstrengths[i] = a.DSIstrengths[i] + amount
 			if a.DSIstrengths[i] > 2 {
 				a.DSIstrengths[i] = 2
 			} else if a.DSIstrengths[i] < 0 {
 				a.DSIstrengths[i] = 0
 			}
-			break
+			return a.DSIstrengths[i] - old
 		}
 	}
-	a.mutex.Unlock()
+	return 0
 }
 
-func (a *Agent) ModulateCT(amount float64) {
+func (a *Agent) ModulateCT(amount float64) float64 {
 	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	old := a.cortisol
 	a.cortisol = a.cortisol + amount
 	if a.cortisol < 0 {
 		a.cortisol = 0
@@ -699,19 +785,21 @@ func (a *Agent) ModulateCT(amount float64) {
 	if a.cortisol > 1 {
 		a.cortisol = 1
 	}
-	a.mutex.Unlock()
+	return a.cortisol - old
 }
-func (a *Agent) IncreaseOT(intensity float64) {
+func (a *Agent) IncreaseOT(intensity float64) float64 {
 	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	old := a.oxytocin
 	a.oxytocin = a.oxytocin + intensity
 	if a.oxytocin > 1 {
 		a.oxytocin = 1
 	}
-	a.mutex.Unlock()
+	return a.oxytocin - old
 }
 
-func randBool() bool {
-	return rand.Float32() < 0.5
+func (a *Agent) randBool() bool {
+	return a.rng.Float32() < 0.5
 }
 
 func (a *Agent) Rank() int          { return a.rank }
@@ -720,3 +808,22 @@ func (a *Agent) Direction() float64 { return a.direction }
 func (a *Agent) Alive() bool        { return a.alive }
 func (a *Agent) X() float64         { return a.x }
 func (a *Agent) Y() float64         { return a.y }
+
+// getters of the internal state, for reporting
+// so they must not be called while the agent runs
+
+func (a *Agent) Energy() float64     { return a.energy }
+func (a *Agent) Cortisol() float64   { return a.cortisol }
+func (a *Agent) Oxytocin() float64   { return a.oxytocin }
+func (a *Agent) Socialness() float64 { return a.socialness }
+func (a *Agent) Stressed() bool      { return a.stressed }
+func (a *Agent) Motivation() float64 { return a.motivation }
+
+// GroomedWith and AggressionOn are the agents groomed or attacked
+// in the last iteration, 0 if none.
+func (a *Agent) GroomedWith() int    { return a.groomedWith }
+func (a *Agent) AggressionOn() int   { return a.aggressionOn }
+func (a *Agent) BondPartners() []int { return append([]int(nil), a.bondPartners...) }
+func (a *Agent) DSIStrengths() []float64 {
+	return append([]float64(nil), a.DSIstrengths...)
+}
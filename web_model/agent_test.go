@@ -0,0 +1,59 @@
+package web_model
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+)
+
+func TestMoveIntoWall(t *testing.T) {
+	for _, rule := range []web_lib.CollisionRule{web_lib.CollisionReject, web_lib.CollisionReflect, web_lib.CollisionSlide} {
+		a, agents, _ := newTestAgents(t, FoodAccess{}, []int{1}, [][2]float64{{49.8, 10}})
+		grid := a.World().(*Grid)
+		grid.SetCollisionRule(rule)
+		if err := grid.AddWall(50, 0, 50, 99); err != nil {
+			t.Fatal(err)
+		}
+		agent := agents[0]
+		agent.direction = 0
+		// north east, into the wall
+		agent.move(45)
+		agent.Act()
+		if !agent.collided {
+			t.Fatalf("%s: no collision", rule)
+		}
+		switch {
+		case agent.X() >= 50:
+			t.Fatalf("%s: went through the wall to %v,%v", rule, agent.X(), agent.Y())
+		case rule == web_lib.CollisionReject && (agent.X() != 49.8 || agent.Y() != 10 || agent.Direction() != 0):
+			t.Fatalf("reject: moved to %v,%v heading %v", agent.X(), agent.Y(), agent.Direction())
+		case rule == web_lib.CollisionReflect && (agent.Y() <= 10 || agent.Direction() != 315):
+			t.Fatalf("reflect: moved to %v,%v heading %v", agent.X(), agent.Y(), agent.Direction())
+		case rule == web_lib.CollisionSlide && (agent.Y() <= 10 || agent.Direction() != 45):
+			t.Fatalf("slide: moved to %v,%v heading %v", agent.X(), agent.Y(), agent.Direction())
+		}
+	}
+}
+
+func TestEatLastBite(t *testing.T) {
+	a, agents, food := newTestAgents(t, FoodAccess{Policy: AccessScramble, Bite: BiteFull}, []int{1, 2},
+		[][2]float64{{9.5, 9}, {9, 9.5}})
+	a.World().Tick(a.Agents())
+	// a bite and a half left for two agents taking a bite each
+	food.resource = 1.5 * food.BiteSize()
+	for _, agent := range agents {
+		agent.energy, agent.foodTimeWaiting = 0.5, 5
+		agent.findEatFood(nil, []web_lib.Agent{food}, nil)
+	}
+	for _, agent := range agents {
+		if agent.Energy() != 0.5 {
+			t.Fatalf("agent %d gained energy before acting", agent.ID())
+		}
+		agent.Act()
+	}
+	first, second := agents[0].Energy()-0.5, agents[1].Energy()-0.5
+	if food.Alive() || math.Abs(first-food.BiteSize()) > 1e-12 || math.Abs(second-food.BiteSize()/2) > 1e-12 {
+		t.Fatalf("agents gained %v and %v from %v", first, second, 1.5*food.BiteSize())
+	}
+}
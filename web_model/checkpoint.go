@@ -0,0 +1,444 @@
+package web_model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+)
+
+// CheckpointVersion is written to every checkpoint,
+// loading refuses checkpoints with a different version.
+const CheckpointVersion = 1
+
+// Checkpoint is the complete state of a simulation between two
+// iterations. Everything recomputed at the start of an iteration
+// (agent vision, food owners and eating agents) is left out, except
+// the order agents wait in with a queue or exclusive food access.
+type Checkpoint struct {
+	Version   int
+	Seed      int64
+	RandState uint64
+	Ticks     int
+	Limit     int
+	Scheduler string
+	Grid      gridState
+	Entities  []entityState // in the order the ABM runs them
+}
+
+type gridState struct {
+	Width, Height  int
+	VisionLength   int
+	VisionAngle    int
+	NumberOfAgents int
+	Schedule       *Schedule `json:",omitempty"` // with the world dynamics, if any
+	ScheduleRand   uint64    `json:",omitempty"`
+	Border         string
+	Collision      string
+	Access         FoodAccess
+	Walls          []Segment
+	Obstacles      []Polygon
+	Iteration      int
+	Season         int
+}
+
+type entityState struct {
+	Kind  string      // agent or food
+	Agent *agentState `json:",omitempty"`
+	Food  *foodState  `json:",omitempty"`
+}
+
+type agentState struct {
+	ID                      int
+	Rank                    int
+	NumOfAgents             int
+	Iteration               int
+	X, Y                    float64
+	OrigX, OrigY            float64
+	Direction               float64
+	Trail                   bool
+	RandState               uint64
+	Alive                   bool
+	Oxytocin                float64
+	Cortisol                float64
+	Energy                  float64
+	Socialness              float64
+	Stressed                bool
+	NutritionChange         float64
+	SocialChange            float64
+	OxytocinChange          float64
+	CortisolChange          float64
+	AdaptiveThreshold       float64
+	BondPartners            []int
+	DSIstrengths            []float64
+	FoodTimeWaiting         int
+	Motivation              float64
+	PhysEffTouch            float64
+	TouchIntensity          float64
+	TactileIntensity        float64
+	DSImode                 string
+	PsychEffEatTogether     float64
+	JustEaten               bool
+	SharedFoodWith          []int
+	GroomedWith             int
+	AggressionOn            int
+	Collided                bool
+	EatingTogetherIntensity float64
+	StepSize                float64
+	TactileEat              float64
+}
+
+type foodState struct {
+	X, Y        float64
+	Alive       bool
+	Hidden      bool
+	Resource    float64
+	MaxResource float64
+	Model       FoodModel
+	Age         int    `json:",omitempty"`
+	RespawnIn   int    `json:",omitempty"`
+	RandState   uint64 `json:",omitempty"`
+	Queue       []int  `json:",omitempty"` // ids of the agents waiting in order
+}
+
+// NewCheckpoint captures the state of a, which must be a simulation
+// on a Grid. It must be called between iterations, from the report
+// function or once StartSimulation has returned.
+func NewCheckpoint(a *web_lib.ABM) (*Checkpoint, error) {
+	grid, ok := a.World().(*Grid)
+	if !ok {
+		return nil, errors.New("checkpoint needs a Grid world")
+	}
+	c := &Checkpoint{
+		Version:   CheckpointVersion,
+		Seed:      a.Seed(),
+		RandState: a.RandState(),
+		Ticks:     a.Ticks(),
+		Limit:     a.Limit(),
+		Scheduler: a.Scheduler().String(),
+	}
+	grid.mx.RLock()
+	c.Grid = gridState{
+		Width:          grid.width,
+		Height:         grid.height,
+		VisionLength:   grid.visionLength,
+		VisionAngle:    grid.visionAngle,
+		NumberOfAgents: len(grid.agentVision),
+		Border:         grid.border.String(),
+		Collision:      grid.collision.String(),
+		Access:         grid.access,
+		Walls:          append([]Segment(nil), grid.interior...),
+		Obstacles:      append([]Polygon(nil), grid.obstacles...),
+		Iteration:      grid.iteration,
+	}
+	grid.mx.RUnlock()
+	switch d := grid.dynamics.(type) {
+	case nil:
+	case *Schedule:
+		schedule := *d
+		c.Grid.Schedule = &schedule
+		c.Grid.ScheduleRand = d.source().State()
+		c.Grid.Season = d.season
+	default:
+		return nil, fmt.Errorf("cannot checkpoint world dynamics of type %T", d)
+	}
+	for _, agent := range a.Agents() {
+		switch e := agent.(type) {
+		case *Agent:
+			c.Entities = append(c.Entities, entityState{Kind: "agent", Agent: e.state()})
+		case *Food:
+			c.Entities = append(c.Entities, entityState{Kind: "food", Food: e.state()})
+		default:
+			return nil, fmt.Errorf("cannot checkpoint entity %d of type %T", agent.ID(), agent)
+		}
+	}
+	return c, nil
+}
+
+// Restore rebuilds the simulation, including the occupancy of the
+// grid cells. Report function, stop condition and comm channel are
+// not part of a checkpoint and have to be set again.
+func (c *Checkpoint) Restore() (*web_lib.ABM, *Grid, error) {
+	if c.Version != CheckpointVersion {
+		return nil, nil, fmt.Errorf("checkpoint version %d, expected %d", c.Version, CheckpointVersion)
+	}
+	scheduler, err := web_lib.ParseScheduler(c.Scheduler)
+	if err != nil {
+		return nil, nil, err
+	}
+	a := web_lib.NewSimulation()
+	a.SetScheduler(scheduler)
+	a.SetSeed(c.Seed)
+	a.SetRandState(c.RandState)
+	a.SetTicks(c.Ticks)
+	a.LimitIterations(c.Limit)
+
+	gs := c.Grid
+	border, err := web_lib.ParseBorderRule(gs.Border)
+	if err != nil {
+		return nil, nil, err
+	}
+	collision, err := web_lib.ParseCollisionRule(gs.Collision)
+	if err != nil {
+		return nil, nil, err
+	}
+	grid := NewWorld(gs.Width, gs.Height, gs.NumberOfAgents, gs.VisionLength, gs.VisionAngle, border)
+	grid.SetCollisionRule(collision)
+	if err := grid.SetFoodAccess(gs.Access); err != nil {
+		return nil, nil, err
+	}
+	for _, wall := range gs.Walls {
+		if err := grid.AddWall(wall.X1, wall.Y1, wall.X2, wall.Y2); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, obstacle := range gs.Obstacles {
+		if err := grid.AddObstacle(obstacle); err != nil {
+			return nil, nil, err
+		}
+	}
+	if schedule := gs.Schedule; schedule != nil {
+		schedule.season = gs.Season
+		schedule.source().SetState(gs.ScheduleRand)
+		grid.SetDynamics(schedule)
+	}
+	grid.iteration = gs.Iteration
+	a.SetWorld(grid)
+
+	agents := make(map[int]*Agent)
+	queues := make(map[*Food][]int)
+	for _, e := range c.Entities {
+		switch {
+		case e.Kind == "agent" && e.Agent != nil:
+			agent := e.Agent.restore(grid)
+			if agent.id < 1 || agent.id > len(grid.agentVision) {
+				return nil, nil, fmt.Errorf("agent id %d out of range", agent.id)
+			}
+			a.AddAgent(agent)
+			agents[agent.id] = agent
+			if agent.alive {
+				grid.SetCell(agent.x, agent.y, agent)
+			}
+		case e.Kind == "food" && e.Food != nil:
+			food, err := e.Food.restore(grid)
+			if err != nil {
+				return nil, nil, err
+			}
+			a.AddAgent(food)
+			queues[food] = e.Food.Queue
+			if food.alive && !food.hidden {
+				grid.SetCell(food.x, food.y, food)
+			}
+		default:
+			return nil, nil, fmt.Errorf("invalid checkpoint entity %q", e.Kind)
+		}
+	}
+	for food, ids := range queues {
+		for _, id := range ids {
+			agent, ok := agents[id]
+			if !ok {
+				return nil, nil, fmt.Errorf("food queue has unknown agent %d", id)
+			}
+			food.eatingAgents = append(food.eatingAgents, agent)
+		}
+	}
+	return a, grid, nil
+}
+
+// SaveCheckpoint writes a checkpoint of a as JSON to w.
+func SaveCheckpoint(w io.Writer, a *web_lib.ABM) error {
+	c, err := NewCheckpoint(a)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(c)
+}
+
+// LoadCheckpoint reads a checkpoint written by SaveCheckpoint
+// and restores the simulation from it.
+func LoadCheckpoint(r io.Reader) (*web_lib.ABM, *Grid, error) {
+	var c Checkpoint
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, nil, err
+	}
+	return c.Restore()
+}
+
+// SaveCheckpointFile writes the checkpoint to a temporary file first,
+// so a crash while saving never leaves a broken checkpoint behind.
+func SaveCheckpointFile(path string, a *web_lib.ABM) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := SaveCheckpoint(tmp, a); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func LoadCheckpointFile(path string) (*web_lib.ABM, *Grid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return LoadCheckpoint(f)
+}
+
+func (a *Agent) state() *agentState {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return &agentState{
+		ID:                      a.id,
+		Rank:                    a.rank,
+		NumOfAgents:             a.numOfAgents,
+		Iteration:               a.iteration,
+		X:                       a.x,
+		Y:                       a.y,
+		OrigX:                   a.origx,
+		OrigY:                   a.origy,
+		Direction:               a.direction,
+		Trail:                   a.trail,
+		RandState:               a.src.State(),
+		Alive:                   a.alive,
+		Oxytocin:                a.oxytocin,
+		Cortisol:                a.cortisol,
+		Energy:                  a.energy,
+		Socialness:              a.socialness,
+		Stressed:                a.stressed,
+		NutritionChange:         a.nutritionChange,
+		SocialChange:            a.socialChange,
+		OxytocinChange:          a.oxytocinChange,
+		CortisolChange:          a.cortisolChange,
+		AdaptiveThreshold:       a.adaptiveThreshold,
+		BondPartners:            append([]int(nil), a.bondPartners...),
+		DSIstrengths:            append([]float64(nil), a.DSIstrengths...),
+		FoodTimeWaiting:         a.foodTimeWaiting,
+		Motivation:              a.motivation,
+		PhysEffTouch:            a.physEffTouch,
+		TouchIntensity:          a.touchIntensity,
+		TactileIntensity:        a.tactileIntensity,
+		DSImode:                 a.DSImode,
+		PsychEffEatTogether:     a.psychEffEatTogether,
+		JustEaten:               a.justEaten,
+		SharedFoodWith:          append([]int(nil), a.sharedFoodWith...),
+		GroomedWith:             a.groomedWith,
+		AggressionOn:            a.aggressionOn,
+		Collided:                a.collided,
+		EatingTogetherIntensity: a.eatingTogetherIntensity,
+		StepSize:                a.stepSize,
+		TactileEat:              a.tactileEat,
+	}
+}
+
+func (s *agentState) restore(grid *Grid) *Agent {
+	src := web_lib.NewSource(0)
+	src.SetState(s.RandState)
+	return &Agent{
+		id:                      s.ID,
+		rank:                    s.Rank,
+		numOfAgents:             s.NumOfAgents,
+		iteration:               s.Iteration,
+		x:                       s.X,
+		y:                       s.Y,
+		origx:                   s.OrigX,
+		origy:                   s.OrigY,
+		direction:               s.Direction,
+		trail:                   s.Trail,
+		grid:                    grid,
+		src:                     src,
+		rng:                     rand.New(src),
+		alive:                   s.Alive,
+		oxytocin:                s.Oxytocin,
+		cortisol:                s.Cortisol,
+		energy:                  s.Energy,
+		socialness:              s.Socialness,
+		stressed:                s.Stressed,
+		nutritionChange:         s.NutritionChange,
+		socialChange:            s.SocialChange,
+		oxytocinChange:          s.OxytocinChange,
+		cortisolChange:          s.CortisolChange,
+		adaptiveThreshold:       s.AdaptiveThreshold,
+		bondPartners:            s.BondPartners,
+		DSIstrengths:            s.DSIstrengths,
+		foodTimeWaiting:         s.FoodTimeWaiting,
+		motivation:              s.Motivation,
+		physEffTouch:            s.PhysEffTouch,
+		touchIntensity:          s.TouchIntensity,
+		tactileIntensity:        s.TactileIntensity,
+		DSImode:                 s.DSImode,
+		psychEffEatTogether:     s.PsychEffEatTogether,
+		justEaten:               s.JustEaten,
+		sharedFoodWith:          s.SharedFoodWith,
+		groomedWith:             s.GroomedWith,
+		aggressionOn:            s.AggressionOn,
+		collided:                s.Collided,
+		eatingTogetherIntensity: s.EatingTogetherIntensity,
+		stepSize:                s.StepSize,
+		tactileEat:              s.TactileEat,
+	}
+}
+
+func (f *Food) state() *foodState {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s := &foodState{
+		X:           f.x,
+		Y:           f.y,
+		Alive:       f.alive,
+		Hidden:      f.hidden,
+		Resource:    f.resource,
+		MaxResource: f.maxResource,
+		Model:       f.model,
+		Age:         f.age,
+		RespawnIn:   f.respawnIn,
+	}
+	if f.src != nil {
+		s.RandState = f.src.State()
+	}
+	switch f.grid.access.Policy {
+	case AccessQueue, AccessExclusive:
+		for _, agent := range f.eatingAgents {
+			s.Queue = append(s.Queue, agent.id)
+		}
+	}
+	return s
+}
+
+func (s *foodState) restore(grid *Grid) (*Food, error) {
+	if err := s.Model.Check(); err != nil {
+		return nil, err
+	}
+	src := web_lib.NewSource(0)
+	src.SetState(s.RandState)
+	return &Food{
+		id:          -1,
+		x:           s.X,
+		y:           s.Y,
+		grid:        grid,
+		alive:       s.Alive,
+		hidden:      s.Hidden,
+		resource:    s.Resource,
+		maxResource: s.MaxResource,
+		model:       s.Model,
+		age:         s.Age,
+		respawnIn:   s.RespawnIn,
+		src:         src,
+		rng:         rand.New(src),
+	}, nil
+}
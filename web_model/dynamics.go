@@ -0,0 +1,192 @@
+package web_model
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+)
+
+// WorldDynamics changes the food sources of a grid over time.
+type WorldDynamics interface {
+	// Update is called at the start of every iteration, before the
+	// agents run, with the food sources in the order they were placed.
+	Update(g *Grid, foods []*Food, iteration int)
+	// Season tells where in its cycle the world is.
+	Season() int
+	String() string
+}
+
+// actions of a schedule rule
+const (
+	ActionHide     = "hide"
+	ActionReveal   = "reveal"
+	ActionToggle   = "toggle"
+	ActionCapacity = "capacity" // set the maximum resource to Value
+	ActionScale    = "scale"    // multiply the maximum resource by Value
+)
+
+// Schedule is a declarative WorldDynamics, every rule changes some
+// food sources at the iterations it is due. The season advances every
+// iteration a rule fires and starts over after Seasons, if set.
+type Schedule struct {
+	Name    string
+	Seasons int   `json:",omitempty"`
+	Seed    int64 `json:",omitempty"` // of the rule probabilities
+	Rules   []ScheduleRule
+
+	season int
+	src    *web_lib.Source
+	rng    *rand.Rand
+}
+
+// ScheduleRule fires at iteration Start+Phase and then every Every
+// iterations, Repeat times in all (0 is forever). Without Every it
+// fires once. With a Probability each firing happens only that likely.
+type ScheduleRule struct {
+	Action      string
+	Food        []int   // indices of the food sources in the order they were placed
+	Value       float64 `json:",omitempty"`
+	Start       int     `json:",omitempty"`
+	Phase       int     `json:",omitempty"`
+	Every       int     `json:",omitempty"`
+	Repeat      int     `json:",omitempty"`
+	Probability float64 `json:",omitempty"`
+}
+
+// Preset returns a new schedule for one of the original world
+// conditions. The four food sources are placed at (9,9), (89,89),
+// (9,89) and (89,9); after 2000 iterations Seasonal hides and reveals
+// them one by one every 1000 iterations and Extreme hides all but
+// (89,89) every other 1000 iterations.
+func Preset(name string) (*Schedule, error) {
+	switch name {
+	case "Static":
+		return &Schedule{Name: name}, nil
+	case "Seasonal":
+		s := &Schedule{Name: name, Seasons: 6}
+		for i, change := range []struct {
+			action string
+			food   int
+		}{{ActionHide, 1}, {ActionHide, 0}, {ActionHide, 3}, {ActionReveal, 3}, {ActionReveal, 0}, {ActionReveal, 1}} {
+			s.Rules = append(s.Rules, ScheduleRule{Action: change.action, Food: []int{change.food},
+				Start: 2000, Phase: i * 1000, Every: 6000})
+		}
+		return s, nil
+	case "Extreme":
+		return &Schedule{Name: name, Seasons: 2, Rules: []ScheduleRule{
+			{Action: ActionHide, Food: []int{0, 2, 3}, Start: 2000, Every: 2000},
+			{Action: ActionReveal, Food: []int{0, 2, 3}, Start: 2000, Phase: 1000, Every: 2000},
+		}}, nil
+	}
+	return nil, errors.New("season must be one of: Static, Seasonal or Extreme")
+}
+
+// Check validates the rules for a world with the given number of food sources.
+func (s *Schedule) Check(foods int) error {
+	if s.Seasons < 0 {
+		return errors.New("schedule seasons must not be negative")
+	}
+	for i, r := range s.Rules {
+		switch r.Action {
+		case ActionHide, ActionReveal, ActionToggle:
+		case ActionCapacity, ActionScale:
+			if r.Value < 0 {
+				return fmt.Errorf("schedule rule %d: value must not be negative", i)
+			}
+		default:
+			return fmt.Errorf("schedule rule %d: action must be one of: hide, reveal, toggle, capacity, scale", i)
+		}
+		if len(r.Food) == 0 {
+			return fmt.Errorf("schedule rule %d: no food source", i)
+		}
+		for _, food := range r.Food {
+			if food < 0 || food >= foods {
+				return fmt.Errorf("schedule rule %d: food source %d out of range", i, food)
+			}
+		}
+		if r.Start < 0 || r.Phase < 0 || r.Every < 0 || r.Repeat < 0 {
+			return fmt.Errorf("schedule rule %d: negative timing", i)
+		}
+		if r.Probability < 0 || r.Probability > 1 {
+			return fmt.Errorf("schedule rule %d: probability must be from 0 to 1", i)
+		}
+	}
+	return nil
+}
+
+// due tells whether r is to fire at iteration, before the probability.
+func (r ScheduleRule) due(iteration int) bool {
+	t := iteration - r.Start - r.Phase
+	if t < 0 {
+		return false
+	}
+	if r.Every == 0 {
+		return t == 0
+	}
+	return t%r.Every == 0 && (r.Repeat == 0 || t/r.Every < r.Repeat)
+}
+
+func (s *Schedule) Update(g *Grid, foods []*Food, iteration int) {
+	fired := false
+	for _, r := range s.Rules {
+		if !r.due(iteration) {
+			continue
+		}
+		if r.Probability > 0 && r.Probability < 1 && s.random().Float64() >= r.Probability {
+			continue
+		}
+		fired = true
+		for _, i := range r.Food {
+			if i >= len(foods) || !foods[i].Alive() {
+				continue
+			}
+			food := foods[i]
+			switch r.Action {
+			case ActionHide:
+				g.hideFood(food)
+			case ActionReveal:
+				g.revealFood(food)
+			case ActionToggle:
+				if food.Hidden() {
+					g.revealFood(food)
+				} else {
+					g.hideFood(food)
+				}
+			case ActionCapacity:
+				food.SetMaxResource(r.Value)
+			case ActionScale:
+				food.SetMaxResource(food.MaxResource() * r.Value)
+			}
+		}
+	}
+	if fired {
+		s.season++
+		if s.Seasons > 0 {
+			s.season %= s.Seasons
+		}
+	}
+}
+
+func (s *Schedule) random() *rand.Rand {
+	s.source()
+	return s.rng
+}
+
+// source is created on first use, a checkpoint keeps its state.
+func (s *Schedule) source() *web_lib.Source {
+	if s.src == nil {
+		s.src = web_lib.NewSource(s.Seed)
+		s.rng = rand.New(s.src)
+	}
+	return s.src
+}
+
+func (s *Schedule) Season() int {
+	return s.season
+}
+
+func (s *Schedule) String() string {
+	return s.Name
+}
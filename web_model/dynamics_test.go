@@ -0,0 +1,182 @@
+package web_model
+
+import (
+	"testing"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+)
+
+// newTestWorld places the four food sources of the presets on an empty grid.
+func newTestWorld(t *testing.T) (*Grid, []*Food) {
+	t.Helper()
+	a := web_lib.NewSimulation()
+	g := NewWorld(99, 99, 1, 20, 160, web_lib.BorderAPeriodic)
+	a.SetWorld(g)
+	var foods []*Food
+	for _, pos := range [][2]float64{{9, 9}, {89, 89}, {9, 89}, {89, 9}} {
+		f, err := NewFood(a, pos[0], pos[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.SetCell(f.X(), f.Y(), f)
+		foods = append(foods, f)
+	}
+	return g, foods
+}
+
+func TestScheduleRuleDue(t *testing.T) {
+	for _, tc := range []struct {
+		rule ScheduleRule
+		due  []int
+	}{
+		{ScheduleRule{Start: 3}, []int{3}},
+		{ScheduleRule{Start: 3, Phase: 2}, []int{5}},
+		{ScheduleRule{Start: 2, Every: 4}, []int{2, 6, 10, 14}},
+		{ScheduleRule{Start: 2, Phase: 1, Every: 4, Repeat: 2}, []int{3, 7}},
+	} {
+		var due []int
+		for i := 0; i < 16; i++ {
+			if tc.rule.due(i) {
+				due = append(due, i)
+			}
+		}
+		if len(due) != len(tc.due) {
+			t.Errorf("%+v: due at %v, want %v", tc.rule, due, tc.due)
+			continue
+		}
+		for i := range due {
+			if due[i] != tc.due[i] {
+				t.Errorf("%+v: due at %v, want %v", tc.rule, due, tc.due)
+				break
+			}
+		}
+	}
+}
+
+func TestScheduleUpdate(t *testing.T) {
+	g, foods := newTestWorld(t)
+	s := &Schedule{Seasons: 5, Rules: []ScheduleRule{
+		{Action: ActionHide, Food: []int{1}, Start: 10},
+		{Action: ActionToggle, Food: []int{2}, Start: 10, Every: 20},
+		{Action: ActionScale, Food: []int{0}, Start: 5, Every: 50, Repeat: 2, Value: 0.5},
+	}}
+	if err := s.Check(len(foods)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		s.Update(g, foods, i)
+		switch i {
+		case 9:
+			if foods[1].Hidden() || foods[2].Hidden() || foods[0].MaxResource() != 2 {
+				t.Fatalf("before the rules fire: hidden %v %v, capacity %v", foods[1].Hidden(), foods[2].Hidden(),
+					foods[0].MaxResource())
+			}
+		case 10:
+			if !foods[1].Hidden() || !foods[2].Hidden() || g.cells[g.idx(89, 89)] != nil {
+				t.Fatal("food sources not hidden at iteration 10")
+			}
+		case 30:
+			if !foods[1].Hidden() || foods[2].Hidden() || g.cells[g.idx(9, 89)] != foods[2] {
+				t.Fatal("food source not toggled back at iteration 30")
+			}
+		}
+	}
+	// halved at 5 and 55 only
+	if foods[0].MaxResource() != 1 {
+		t.Fatalf("capacity %v, want 1", foods[0].MaxResource())
+	}
+	// rules fired at 12 iterations: the toggle 10 times, the first time
+	// together with the hide, and the scale twice
+	if s.Season() != 12%5 {
+		t.Fatalf("season %d", s.Season())
+	}
+}
+
+func TestScheduleProbability(t *testing.T) {
+	run := func(seed int64) []bool {
+		g, foods := newTestWorld(t)
+		s := &Schedule{Seed: seed, Rules: []ScheduleRule{
+			{Action: ActionToggle, Food: []int{0}, Every: 1, Probability: 0.5},
+		}}
+		var hidden []bool
+		for i := 0; i < 200; i++ {
+			s.Update(g, foods, i)
+			hidden = append(hidden, foods[0].Hidden())
+		}
+		return hidden
+	}
+	first, again, other := run(1), run(1), run(2)
+	toggles, differ := 0, false
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatal("same seed toggled differently")
+		}
+		if i > 0 && first[i] != first[i-1] {
+			toggles++
+		}
+		differ = differ || first[i] != other[i]
+	}
+	if toggles < 70 || toggles > 130 || !differ {
+		t.Fatalf("%d of 200 toggles with probability 0.5, different seeds differ %v", toggles, differ)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		hidden map[int][]bool // at iterations
+	}{
+		{"Static", map[int][]bool{5000: {false, false, false, false}}},
+		{"Seasonal", map[int][]bool{
+			1999: {false, false, false, false},
+			2000: {false, true, false, false},
+			3000: {true, true, false, false},
+			4000: {true, true, false, true},
+			5000: {true, true, false, false},
+			6000: {false, true, false, false},
+			7000: {false, false, false, false},
+			8000: {false, true, false, false},
+		}},
+		{"Extreme", map[int][]bool{
+			2000: {true, false, true, true},
+			3000: {false, false, false, false},
+			4000: {true, false, true, true},
+		}},
+	} {
+		g, foods := newTestWorld(t)
+		s, err := Preset(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i <= 8000; i++ {
+			s.Update(g, foods, i)
+			want, ok := tc.hidden[i]
+			if !ok {
+				continue
+			}
+			for j, food := range foods {
+				if food.Hidden() != want[j] {
+					t.Fatalf("%s at %d: food source %d hidden %v", tc.name, i, j, food.Hidden())
+				}
+			}
+		}
+	}
+	if _, err := Preset("Windy"); err == nil {
+		t.Fatal("unknown preset")
+	}
+}
+
+func TestScheduleCheck(t *testing.T) {
+	for _, r := range []ScheduleRule{
+		{Action: "flood", Food: []int{0}},
+		{Action: ActionHide},
+		{Action: ActionHide, Food: []int{4}},
+		{Action: ActionScale, Food: []int{0}, Value: -1},
+		{Action: ActionHide, Food: []int{0}, Every: -1},
+		{Action: ActionHide, Food: []int{0}, Probability: 2},
+	} {
+		if err := (&Schedule{Rules: []ScheduleRule{r}}).Check(4); err == nil {
+			t.Errorf("%+v: no error", r)
+		}
+	}
+}
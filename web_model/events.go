@@ -0,0 +1,124 @@
+package web_model
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// kinds of interaction events
+const (
+	EventGroom        = "groom"
+	EventAggression   = "aggression"
+	EventSharedEating = "shared_eating"
+)
+
+// Event is a social interaction between two agents. Deltas are what
+// the interaction actually changed, after clamping. For shared eating
+// there is one event per partner and every one of them carries the
+// oxytocin the actor gained from the whole meal.
+type Event struct {
+	Tick        int
+	Kind        string
+	Actor       int
+	Target      int
+	Intensity   float64 // tactile intensity of the actor
+	ActorDelta  Delta
+	TargetDelta Delta
+}
+
+type Delta struct {
+	Cortisol float64
+	Oxytocin float64
+	DSI      float64 // towards the other agent of the event
+}
+
+// EventQuery selects events, zero fields match everything.
+// From and To are inclusive ticks, Agent matches actor or target.
+type EventQuery struct {
+	Kind     string
+	Agent    int
+	From, To int
+	HasTo    bool
+}
+
+func (q EventQuery) match(e Event) bool {
+	return (q.Kind == "" || q.Kind == e.Kind) &&
+		(q.Agent == 0 || q.Agent == e.Actor || q.Agent == e.Target) &&
+		e.Tick >= q.From && (!q.HasTo || e.Tick <= q.To)
+}
+
+// EventLog keeps the events of a run in memory and writes them as JSON
+// lines. Add is meant to be set with Grid.SetEventFunc, it is called
+// by the engine while the log may be queried from other goroutines.
+type EventLog struct {
+	mx     sync.RWMutex
+	events []Event
+	limit  int // events kept in memory, the oldest are dropped first
+
+	w      *bufio.Writer
+	closer io.Closer
+	json   *json.Encoder
+	err    error
+}
+
+// NewEventLog writes events to w, which may be nil, and keeps the
+// last limit of them for Query. If w is an io.Closer, Close closes it.
+func NewEventLog(w io.Writer, limit int) *EventLog {
+	l := &EventLog{limit: limit}
+	if w != nil {
+		l.w = bufio.NewWriter(w)
+		l.json = json.NewEncoder(l.w)
+		if c, ok := w.(io.Closer); ok {
+			l.closer = c
+		}
+	}
+	return l
+}
+
+func (l *EventLog) Add(e Event) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.limit > 0 {
+		l.events = append(l.events, e)
+		if len(l.events) > l.limit {
+			l.events = l.events[len(l.events)-l.limit:]
+		}
+	}
+	if l.json != nil && l.err == nil {
+		l.err = l.json.Encode(e)
+	}
+}
+
+// Query returns the kept events matching q in the order they happened.
+func (l *EventLog) Query(q EventQuery) []Event {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	events := []Event{}
+	for _, e := range l.events {
+		if q.match(e) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Close flushes the written events and closes the underlying writer.
+func (l *EventLog) Close() error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.w == nil {
+		return nil
+	}
+	if err := l.w.Flush(); l.err == nil {
+		l.err = err
+	}
+	err := l.err
+	if l.closer != nil {
+		if cerr := l.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package web_model
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ExportOptions change how a run is exported, on top of how
+// every frame is rendered.
+type ExportOptions struct {
+	RenderOptions
+	Skip    int  // export every Skip-th snapshot, all of them if not set
+	Overlay bool // the iteration and the season in the corner
+	Delay   int  // between GIF frames in 100ths of a second, 4 if not set
+}
+
+// Exporter turns the snapshots of a run into an animated GIF or into a
+// numbered sequence of PNG images. Every frame is written as it is
+// added, Skip and Scale keep the output of long runs small.
+type Exporter struct {
+	options ExportOptions
+	w       io.Writer // of the GIF
+	dir     string
+	seen    int
+	frames  int
+	err     error
+}
+
+func NewGIFExporter(w io.Writer, o ExportOptions) *Exporter {
+	return &Exporter{options: o, w: w}
+}
+
+// NewPNGExporter writes frame_00000.png, frame_00001.png and
+// so on into dir.
+func NewPNGExporter(dir string, o ExportOptions) *Exporter {
+	return &Exporter{options: o, dir: dir}
+}
+
+// Add renders s if it is not skipped.
+func (e *Exporter) Add(s *Snapshot) {
+	skip := e.options.Skip
+	if skip < 1 {
+		skip = 1
+	}
+	e.seen++
+	if e.err != nil || (e.seen-1)%skip != 0 {
+		return
+	}
+	img := Render(s, e.options.RenderOptions)
+	if e.options.Overlay {
+		overlay(img, s)
+	}
+	if e.w != nil {
+		e.err = e.writeGIFFrame(img)
+	} else {
+		e.err = WritePNG(filepath.Join(e.dir, fmt.Sprintf("frame_%05d.png", e.frames)), img)
+	}
+	e.frames++
+}
+
+func WritePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Frames returns the number of frames exported so far.
+func (e *Exporter) Frames() int {
+	return e.frames
+}
+
+// writeGIFFrame encodes img as a GIF of its own, all of them have the
+// same global palette. The first one gives the header of the animation,
+// of the others only the frame itself is written.
+func (e *Exporter) writeGIFFrame(img image.Image) error {
+	frame := image.NewPaletted(img.Bounds(), palette.Plan9)
+	draw.Draw(frame, frame.Bounds(), img, image.Point{}, draw.Src)
+	delay := e.options.Delay
+	if delay < 1 {
+		delay = 4
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:  []*image.Paletted{frame},
+		Delay:  []int{delay},
+		Config: image.Config{ColorModel: color.Palette(palette.Plan9), Width: frame.Rect.Dx(), Height: frame.Rect.Dy()},
+	})
+	if err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	// signature and logical screen descriptor, then the global color table
+	header := 13
+	if b[10]&0x80 != 0 {
+		header += 3 << (b[10]&7 + 1)
+	}
+	if e.frames == 0 {
+		if _, err := e.w.Write(b[:header]); err != nil {
+			return err
+		}
+		// loop forever
+		loop := []byte{0x21, 0xff, 0x0b, 'N', 'E', 'T', 'S', 'C', 'A', 'P', 'E', '2', '.', '0', 0x03, 0x01, 0, 0, 0}
+		if _, err := e.w.Write(loop); err != nil {
+			return err
+		}
+	}
+	// without the trailer
+	_, err = e.w.Write(b[header : len(b)-1])
+	return err
+}
+
+// Close ends the GIF, it does not close the underlying writer.
+func (e *Exporter) Close() error {
+	if e.err != nil || e.w == nil {
+		return e.err
+	}
+	if e.frames == 0 {
+		return fmt.Errorf("no frames to export")
+	}
+	_, e.err = e.w.Write([]byte{0x3b})
+	return e.err
+}
+
+func overlay(img *image.RGBA, s *Snapshot) {
+	text := "TICK " + strconv.Itoa(s.Iteration+1)
+	if s.World != "" && s.World != "Static" {
+		text += " " + s.World + " " + strconv.Itoa(s.Season)
+	}
+	c := &canvas{img: img, scale: 1}
+	drawText(c, 3, 3, strings.ToUpper(text), 2, color.RGBA{0xff, 0xff, 0xff, 0xff})
+}
+
+// font is 3x5 pixels per character, a # is set.
+var font = map[rune]string{
+	'0': "####.##.##.####", '1': ".#.##..#..#.###", '2': "###..#####..###", '3': "###..####..####",
+	'4': "#.##.####..#..#", '5': "####..###..####", '6': "####..####.####", '7': "###..#..#..#..#",
+	'8': "####.#####.####", '9': "####.####..####", 'A': ".#.#.#####.##.#", 'B': "##.#.###.#.###.",
+	'C': "####..#..#..###", 'D': "##.#.##.##.###.", 'E': "####..####..###", 'F': "####..####..#..",
+	'G': "####..#.##.####", 'H': "#.##.#####.##.#", 'I': "###.#..#..#.###", 'J': "..#..#..##.####",
+	'K': "#.##.###.#.##.#", 'L': "#..#..#..#..###", 'M': "#.########.##.#", 'N': "##.#.##.##.##.#",
+	'O': "####.##.##.####", 'P': "####.#####..#..", 'Q': "####.##.####..#", 'R': "##.#.###.#.##.#",
+	'S': "####..###..####", 'T': "###.#..#..#..#.", 'U': "#.##.##.##.####", 'V': "#.##.##.##.#.#.",
+	'W': "#.##.########.#", 'X': "#.##.#.#.#.##.#", 'Y': "#.##.#.#..#..#.", 'Z': "###..#.#.#..###",
+}
+
+// drawText writes text from pixel x, y, every font pixel size pixels big.
+func drawText(c *canvas, x, y int, text string, size int, col color.RGBA) {
+	for _, r := range text {
+		if glyph, ok := font[r]; ok {
+			for i, p := range glyph {
+				if p != '#' {
+					continue
+				}
+				for dy := 0; dy < size; dy++ {
+					for dx := 0; dx < size; dx++ {
+						c.blend(x+(i%3)*size+dx, y+(i/3)*size+dy, col)
+					}
+				}
+			}
+		}
+		x += 4 * size
+	}
+}
@@ -3,6 +3,7 @@ package web_model
 import (
 	"errors"
 	"github.com/Kubiuks/Alife_web/web_lib"
+	"math/rand"
 	"sync"
 )
 
@@ -14,11 +15,16 @@ type Food struct {
 	maxResource  float64
 	owner		 *Agent
 	eatingAgents []*Agent
+	model		 FoodModel
+	age			 int // iterations run, for pulsed regrowth
+	respawnIn	 int
 	// implementation
 	mutex 		 sync.Mutex
 	id 			 int
 	x, y         float64
 	grid         *Grid
+	src			 *web_lib.Source // for random respawns
+	rng			 *rand.Rand
 }
 
 func NewFood(abm *web_lib.ABM, x, y float64) (*Food, error) {
@@ -30,7 +36,10 @@ func NewFood(abm *web_lib.ABM, x, y float64) (*Food, error) {
 	if !ok {
 		return nil, errors.New("agent needs a Grid world to operate")
 	}
+	model := FoodModel{}
+	model.Check()
 	return &Food{
+		model: model,
 		alive: true,
 		hidden: false,
 		resource: 4,
@@ -47,27 +56,47 @@ func (f *Food) Run() {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 	if !f.alive {
+		f.respawn()
 		return
 	}
-	if f.resource < f.maxResource {
-		f.resource += 0.001
-	}
-	if f.resource > f.maxResource {
-		f.resource = f.maxResource
-	}
+	f.regrow()
 }
 
-func (f *Food) reduceResource(amount float64){
+// reduceResource takes up to amount from f and returns what it took,
+// nothing once f is eaten up.
+func (f *Food) reduceResource(amount float64) float64{
 	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.alive {
+		return 0
+	}
+	if amount > f.resource {
+		amount = f.resource
+	}
 	f.resource -= amount
 	if f.resource <=0 {
-		f.alive = false
-		f.resource = 0
-		f.grid.ClearCell(f.x, f.y, f.id)
+		f.depleted()
+	}
+	return amount
+}
+
+// SetMaxResource changes the capacity of the food source,
+// a resource above it is cut down to it.
+func (f *Food) SetMaxResource(max float64) {
+	f.mutex.Lock()
+	f.maxResource = max
+	if f.resource > max {
+		f.resource = max
 	}
 	f.mutex.Unlock()
 }
 
+func (f *Food) MaxResource() float64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.maxResource
+}
+
 func (f *Food) Resource() float64{
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
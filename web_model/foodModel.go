@@ -0,0 +1,157 @@
+package web_model
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+)
+
+// regrowth models of food sources
+const (
+	RegrowthLinear   = "linear"   // Rate every iteration
+	RegrowthLogistic = "logistic" // Rate times resource times the room left
+	RegrowthPulsed   = "pulsed"   // Rate at once every Pulse iterations
+	RegrowthNone     = "none"     // never, Rate is not used
+)
+
+// what happens to a food source once it is eaten up
+const (
+	RespawnNone    = "none"   // it is gone for good
+	RespawnInPlace = "place"  // it grows back where it was
+	RespawnRandom  = "random" // it grows back somewhere else
+)
+
+// FoodModel is how a food source grows and what happens once it is
+// eaten up. The zero value is the original food source: capacity 4,
+// bites of 0.01, linear regrowth of 0.001 and no respawn.
+type FoodModel struct {
+	Capacity     float64 `json:",omitempty"`
+	Bite         float64 `json:",omitempty"`
+	Regrowth     string  `json:",omitempty"`
+	Rate         float64 `json:",omitempty"`
+	Pulse        int     `json:",omitempty"`
+	Respawn      string  `json:",omitempty"`
+	RespawnDelay int     `json:",omitempty"` // iterations until a respawn
+	Seed         int64   `json:",omitempty"` // of random respawn locations
+}
+
+// Check validates m and fills in the defaults.
+func (m *FoodModel) Check() error {
+	if m.Capacity < 0 || m.Bite < 0 || m.Rate < 0 || m.Pulse < 0 || m.RespawnDelay < 0 {
+		return errors.New("food capacity, bite, rate, pulse and respawn delay must not be negative")
+	}
+	if m.Capacity == 0 {
+		m.Capacity = 4
+	}
+	if m.Bite == 0 {
+		m.Bite = 0.01
+	}
+	if m.Rate == 0 {
+		m.Rate = 0.001
+	}
+	switch m.Regrowth {
+	case "":
+		m.Regrowth = RegrowthLinear
+	case RegrowthLinear, RegrowthLogistic, RegrowthNone:
+	case RegrowthPulsed:
+		if m.Pulse == 0 {
+			return errors.New("pulsed regrowth needs a pulse")
+		}
+	default:
+		return errors.New("regrowth must be one of: linear, logistic, pulsed, none")
+	}
+	switch m.Respawn {
+	case "":
+		m.Respawn = RespawnNone
+	case RespawnNone, RespawnInPlace, RespawnRandom:
+	default:
+		return errors.New("respawn must be one of: none, place, random")
+	}
+	return nil
+}
+
+// SetModel changes how f grows, it starts full. It must be
+// called before the simulation starts.
+func (f *Food) SetModel(m FoodModel) error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	f.model = m
+	f.maxResource = m.Capacity
+	f.resource = m.Capacity
+	f.src = web_lib.NewSource(m.Seed)
+	f.rng = rand.New(f.src)
+	f.mutex.Unlock()
+	return nil
+}
+
+func (f *Food) Model() FoodModel {
+	return f.model
+}
+
+// BiteSize is what an agent takes from f at once.
+func (f *Food) BiteSize() float64 {
+	return f.model.Bite
+}
+
+// regrow is called with the lock held.
+func (f *Food) regrow() {
+	f.age++
+	switch f.model.Regrowth {
+	case RegrowthLogistic:
+		f.resource += f.model.Rate * f.resource * (1 - f.resource/f.maxResource)
+	case RegrowthPulsed:
+		if f.age%f.model.Pulse == 0 {
+			f.resource += f.model.Rate
+		}
+	case RegrowthNone:
+	default:
+		if f.resource < f.maxResource {
+			f.resource += f.model.Rate
+		}
+	}
+	if f.resource > f.maxResource {
+		f.resource = f.maxResource
+	}
+}
+
+// depleted is called with the lock held once f is eaten up.
+func (f *Food) depleted() {
+	f.alive = false
+	f.resource = 0
+	f.grid.ClearCell(f.x, f.y, f.id)
+	f.respawnIn = f.model.RespawnDelay
+}
+
+// respawn counts down the delay of a depleted food source and
+// lets it grow back, it is called with the lock held.
+func (f *Food) respawn() {
+	if f.model.Respawn != RespawnInPlace && f.model.Respawn != RespawnRandom {
+		return
+	}
+	if f.respawnIn > 0 {
+		f.respawnIn--
+		return
+	}
+	if f.model.Respawn == RespawnRandom {
+		f.x, f.y = f.randomPosition()
+	}
+	f.alive = true
+	f.resource = f.maxResource
+	if !f.hidden {
+		f.grid.SetCell(f.x, f.y, f)
+	}
+}
+
+// randomPosition is a place on the grid outside the obstacles.
+func (f *Food) randomPosition() (float64, float64) {
+	w, h := float64(f.grid.Width()), float64(f.grid.Height())
+	for {
+		x, y := f.rng.Float64()*w, f.rng.Float64()*h
+		if f.grid.validateXY(x, y) == nil && !f.grid.Inside(x, y) {
+			return x, y
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package web_model
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+)
+
+// newTestFood places a food source with model m at 9,9 of an empty grid.
+func newTestFood(t *testing.T, m FoodModel) (*Food, *Grid) {
+	t.Helper()
+	a := web_lib.NewSimulation()
+	g := NewWorld(100, 100, 1, 20, 160, web_lib.BorderAPeriodic)
+	a.SetWorld(g)
+	f, err := NewFood(a, 9, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetCell(f.X(), f.Y(), f)
+	if err := f.SetModel(m); err != nil {
+		t.Fatal(err)
+	}
+	return f, g
+}
+
+func TestFoodRegrowth(t *testing.T) {
+	for _, tc := range []struct {
+		model FoodModel
+		want  float64 // after eating 1 and running 10 iterations
+	}{
+		{FoodModel{Capacity: 2, Rate: 0.01}, 1.1},
+		{FoodModel{Capacity: 2, Rate: 0.5, Regrowth: RegrowthLinear}, 2},
+		{FoodModel{Capacity: 2, Rate: 0.1, Regrowth: RegrowthLogistic}, 1.4668},
+		{FoodModel{Capacity: 2, Rate: 0.3, Regrowth: RegrowthPulsed, Pulse: 4}, 1.6},
+		{FoodModel{Capacity: 2, Rate: 0.3, Regrowth: RegrowthNone}, 1},
+	} {
+		f, _ := newTestFood(t, tc.model)
+		f.reduceResource(1)
+		for i := 0; i < 10; i++ {
+			f.Run()
+		}
+		if math.Abs(f.Resource()-tc.want) > 1e-4 {
+			t.Errorf("%s: resource %v, want %v", tc.model.Regrowth, f.Resource(), tc.want)
+		}
+	}
+}
+
+func TestFoodRespawn(t *testing.T) {
+	for _, respawn := range []string{RespawnNone, RespawnInPlace, RespawnRandom} {
+		f, g := newTestFood(t, FoodModel{Capacity: 1, Respawn: respawn, RespawnDelay: 3, Seed: 1})
+		f.reduceResource(1)
+		if f.Alive() || g.cells[g.idx(9, 9)] != nil {
+			t.Fatalf("%s: eaten up food source still there", respawn)
+		}
+		for i := 0; i < 3; i++ {
+			f.Run()
+		}
+		if f.Alive() {
+			t.Fatalf("%s: back before the delay", respawn)
+		}
+		f.Run()
+		if f.Alive() != (respawn != RespawnNone) {
+			t.Fatalf("%s: alive %v after the delay", respawn, f.Alive())
+		}
+		if !f.Alive() {
+			continue
+		}
+		moved := f.X() != 9 || f.Y() != 9
+		if moved != (respawn == RespawnRandom) || f.Resource() != 1 || g.cells[g.idx(f.X(), f.Y())] != f {
+			t.Fatalf("%s: back at %v,%v with %v", respawn, f.X(), f.Y(), f.Resource())
+		}
+	}
+}
+
+func TestFoodModelCheck(t *testing.T) {
+	for _, m := range []FoodModel{
+		{Rate: -1},
+		{Regrowth: RegrowthPulsed},
+		{Regrowth: "exponential"},
+		{Respawn: "elsewhere"},
+	} {
+		if err := m.Check(); err == nil {
+			t.Errorf("%+v: no error", m)
+		}
+	}
+}
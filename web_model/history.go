@@ -0,0 +1,62 @@
+package web_model
+
+import "sync"
+
+// History keeps the most recent snapshots of a run in a ring buffer,
+// the oldest are overwritten first. Add is called by the engine while
+// the history may be read from other goroutines.
+type History struct {
+	mx        sync.RWMutex
+	snapshots []*Snapshot
+	start     int // index of the oldest snapshot
+	count     int
+}
+
+// NewHistory keeps up to capacity snapshots, at least one.
+func NewHistory(capacity int) *History {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &History{snapshots: make([]*Snapshot, capacity)}
+}
+
+func (h *History) Add(s *Snapshot) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if h.count < len(h.snapshots) {
+		h.snapshots[(h.start+h.count)%len(h.snapshots)] = s
+		h.count++
+		return
+	}
+	h.snapshots[h.start] = s
+	h.start = (h.start + 1) % len(h.snapshots)
+}
+
+// Bounds returns the iterations of the oldest and the latest
+// snapshot kept, ok is false if there is none yet.
+func (h *History) Bounds() (first, last int, ok bool) {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	if h.count == 0 {
+		return 0, 0, false
+	}
+	return h.at(0).Iteration, h.at(h.count - 1).Iteration, true
+}
+
+// Range returns the snapshots kept from iteration from to iteration
+// to, both included, oldest first.
+func (h *History) Range(from, to int) []*Snapshot {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	snapshots := []*Snapshot{}
+	for i := 0; i < h.count; i++ {
+		if s := h.at(i); s.Iteration >= from && s.Iteration <= to {
+			snapshots = append(snapshots, s)
+		}
+	}
+	return snapshots
+}
+
+func (h *History) at(i int) *Snapshot {
+	return h.snapshots[(h.start+i)%len(h.snapshots)]
+}
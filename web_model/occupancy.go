@@ -0,0 +1,210 @@
+package web_model
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// kinds of heatmaps
+const (
+	HeatmapPopulation = "population"
+	HeatmapStressed   = "stressed"
+	HeatmapUnstressed = "unstressed"
+	HeatmapAgent      = "agent"
+)
+
+// Occupancy accumulates how many iterations living agents spent in every
+// cell of the world, and the trajectory of every agent. Record is meant
+// to get the snapshot of every iteration, the results may be read from
+// other goroutines meanwhile.
+type Occupancy struct {
+	mx            sync.RWMutex
+	width, height int
+	population    []int
+	stressed      []int
+	unstressed    []int
+	agents        map[int][]int
+	trajectories  map[int]*Trajectory
+}
+
+// Heatmap counts iterations spent in the cells of one grid unit,
+// row by row from the top left.
+type Heatmap struct {
+	Kind          string
+	Agent         int `json:",omitempty"`
+	Width, Height int
+	Counts        []int
+	Max           int
+}
+
+// Trajectory is where an agent was at every iteration it was alive.
+type Trajectory struct {
+	ID     int
+	Rank   int
+	Points []Point
+}
+
+type Point struct {
+	Iteration int
+	X, Y      float64
+}
+
+func NewOccupancy() *Occupancy {
+	return &Occupancy{
+		agents:       make(map[int][]int),
+		trajectories: make(map[int]*Trajectory),
+	}
+}
+
+func (o *Occupancy) Record(s *Snapshot) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	if o.population == nil {
+		o.width, o.height = s.Width, s.Height
+		o.population = make([]int, o.width*o.height)
+		o.stressed = make([]int, o.width*o.height)
+		o.unstressed = make([]int, o.width*o.height)
+	}
+	for _, e := range s.Entities {
+		if e.Agent == nil || !e.Agent.Alive {
+			continue
+		}
+		cell := o.cell(e.X, e.Y)
+		o.population[cell]++
+		if e.Agent.Stressed {
+			o.stressed[cell]++
+		} else {
+			o.unstressed[cell]++
+		}
+		counts, ok := o.agents[e.ID]
+		if !ok {
+			counts = make([]int, o.width*o.height)
+			o.agents[e.ID] = counts
+		}
+		counts[cell]++
+		trajectory, ok := o.trajectories[e.ID]
+		if !ok {
+			trajectory = &Trajectory{ID: e.ID, Rank: e.Agent.Rank}
+			o.trajectories[e.ID] = trajectory
+		}
+		trajectory.Points = append(trajectory.Points, Point{s.Iteration, e.X, e.Y})
+	}
+}
+
+func (o *Occupancy) cell(x, y float64) int {
+	cx := int(math.Min(math.Max(x, 0), float64(o.width-1)))
+	cy := int(math.Min(math.Max(y, 0), float64(o.height-1)))
+	return cy*o.width + cx
+}
+
+// Heatmap returns a copy of the heatmap of the given kind, agent
+// is only needed for the heatmap of a single agent.
+func (o *Occupancy) Heatmap(kind string, agent int) (Heatmap, error) {
+	o.mx.RLock()
+	defer o.mx.RUnlock()
+	h := Heatmap{Kind: kind, Width: o.width, Height: o.height}
+	var counts []int
+	switch kind {
+	case HeatmapPopulation:
+		counts = o.population
+	case HeatmapStressed:
+		counts = o.stressed
+	case HeatmapUnstressed:
+		counts = o.unstressed
+	case HeatmapAgent:
+		h.Agent = agent
+		var ok bool
+		if counts, ok = o.agents[agent]; !ok {
+			return h, errors.New("no agent " + strconv.Itoa(agent) + " recorded")
+		}
+	default:
+		return h, errors.New("heatmap must be one of: population, stressed, unstressed, agent")
+	}
+	h.Counts = append([]int{}, counts...)
+	for _, n := range h.Counts {
+		if n > h.Max {
+			h.Max = n
+		}
+	}
+	return h, nil
+}
+
+// Trajectories returns a copy of the trajectories of all agents
+// ordered by id, or of the one agent if it is not 0.
+func (o *Occupancy) Trajectories(agent int) []Trajectory {
+	o.mx.RLock()
+	defer o.mx.RUnlock()
+	trajectories := []Trajectory{}
+	for id, t := range o.trajectories {
+		if agent == 0 || agent == id {
+			trajectories = append(trajectories, Trajectory{t.ID, t.Rank, append([]Point{}, t.Points...)})
+		}
+	}
+	sort.Slice(trajectories, func(i, j int) bool { return trajectories[i].ID < trajectories[j].ID })
+	return trajectories
+}
+
+// RenderHeatmap draws h from black over red and yellow to white,
+// scale pixels per cell. The square root of the counts is used so
+// that rarely visited cells still show.
+func RenderHeatmap(h Heatmap, scale int) *image.RGBA {
+	if scale < 1 {
+		scale = 5
+	}
+	img := image.NewRGBA(image.Rect(0, 0, h.Width*scale, h.Height*scale))
+	for i, n := range h.Counts {
+		var v float64
+		if h.Max > 0 {
+			v = math.Sqrt(float64(n) / float64(h.Max))
+		}
+		col := heat(v)
+		x, y := (i%h.Width)*scale, (i/h.Width)*scale
+		for dy := 0; dy < scale; dy++ {
+			for dx := 0; dx < scale; dx++ {
+				img.SetRGBA(x+dx, y+dy, col)
+			}
+		}
+	}
+	return img
+}
+
+func heat(v float64) color.RGBA {
+	channel := func(from float64) uint8 {
+		return uint8(math.Min(math.Max((v-from)*3, 0), 1) * 0xff)
+	}
+	return color.RGBA{channel(0), channel(1.0 / 3), channel(2.0 / 3), 0xff}
+}
+
+// RenderTrajectories draws the trajectories as lines in the colors of
+// the ranks of the agents, on the world of s. Steps across the border
+// of a periodic world are left out.
+func RenderTrajectories(s *Snapshot, trajectories []Trajectory, scale int) *image.RGBA {
+	if scale < 1 {
+		scale = 5
+	}
+	c := &canvas{
+		img:   image.NewRGBA(image.Rect(0, 0, s.Width*scale, s.Height*scale)),
+		scale: float64(scale),
+	}
+	c.fill(backgroundColor)
+	for _, wall := range s.Walls {
+		c.line(wall.X1, wall.Y1, wall.X2, wall.Y2, 2, wallColor)
+	}
+	for _, t := range trajectories {
+		col := rankColors[t.Rank%len(rankColors)]
+		col.A = 0xa0
+		for i := 1; i < len(t.Points); i++ {
+			p, q := t.Points[i-1], t.Points[i]
+			if math.Abs(q.X-p.X) > float64(s.Width)/2 || math.Abs(q.Y-p.Y) > float64(s.Height)/2 {
+				continue
+			}
+			c.line(p.X, p.Y, q.X, q.Y, 1, col)
+		}
+	}
+	return c.img
+}
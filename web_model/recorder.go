@@ -0,0 +1,155 @@
+package web_model
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Recorder samples the physiology of every agent and writes it as a
+// time series, either CSV with one row per agent and sample or JSON
+// lines with one object per agent and sample.
+//
+// Record is meant to get the snapshot of every iteration.
+type Recorder struct {
+	w      *bufio.Writer
+	closer io.Closer
+	csv    *csv.Writer
+	json   *json.Encoder
+	every  int
+	header bool
+	agents int // DSI columns of the CSV, one for every possible partner
+	err    error
+}
+
+// Sample is the state of one agent at one iteration,
+// it is what the JSON lines format writes.
+type Sample struct {
+	Iteration  int
+	ID         int
+	Alive      bool
+	Energy     float64
+	Cortisol   float64
+	Oxytocin   float64
+	Socialness float64
+	Stressed   bool
+	Motivation float64
+	DSI        map[int]float64 // DSI strength by bond partner id
+}
+
+// NewRecorder writes samples in format (csv or jsonl) to w every
+// so many iterations. If w is an io.Closer, Close closes it.
+func NewRecorder(w io.Writer, format string, every int) (*Recorder, error) {
+	if every < 1 {
+		every = 1
+	}
+	r := &Recorder{
+		w:     bufio.NewWriter(w),
+		every: every,
+	}
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	switch format {
+	case "csv":
+		r.csv = csv.NewWriter(r.w)
+	case "jsonl":
+		r.json = json.NewEncoder(r.w)
+	default:
+		return nil, errors.New("record format must be one of: csv, jsonl")
+	}
+	return r, nil
+}
+
+// Record samples every agent of s if the iteration is due.
+func (r *Recorder) Record(s *Snapshot) {
+	if r.err != nil || (s.Iteration+1)%r.every != 0 {
+		return
+	}
+	agents := s.Agents()
+	if r.agents == 0 {
+		r.agents = len(agents)
+	}
+	for _, e := range agents {
+		r.write(Sample{
+			Iteration:  s.Iteration,
+			ID:         e.ID,
+			Alive:      e.Agent.Alive,
+			Energy:     e.Agent.Energy,
+			Cortisol:   e.Agent.Cortisol,
+			Oxytocin:   e.Agent.Oxytocin,
+			Socialness: e.Agent.Socialness,
+			Stressed:   e.Agent.Stressed,
+			Motivation: e.Agent.Motivation,
+			DSI:        e.Agent.DSI,
+		})
+	}
+}
+
+func (r *Recorder) write(s Sample) {
+	if r.json != nil {
+		r.err = r.json.Encode(s)
+		return
+	}
+	if !r.header {
+		header := []string{"iteration", "id", "alive", "energy", "cortisol", "oxytocin",
+			"socialness", "stressed", "motivation"}
+		for id := 1; id <= r.agents; id++ {
+			header = append(header, "dsi_"+strconv.Itoa(id))
+		}
+		r.header = true
+		r.err = r.csv.Write(header)
+		if r.err != nil {
+			return
+		}
+	}
+	row := []string{strconv.Itoa(s.Iteration), strconv.Itoa(s.ID), strconv.FormatBool(s.Alive),
+		formatFloat(s.Energy), formatFloat(s.Cortisol), formatFloat(s.Oxytocin),
+		formatFloat(s.Socialness), strconv.FormatBool(s.Stressed), formatFloat(s.Motivation)}
+	for id := 1; id <= r.agents; id++ {
+		if dsi, ok := s.DSI[id]; ok {
+			row = append(row, formatFloat(dsi))
+		} else {
+			row = append(row, "")
+		}
+	}
+	r.err = r.csv.Write(row)
+}
+
+// Flush writes buffered samples to the underlying writer.
+func (r *Recorder) Flush() error {
+	if r.csv != nil {
+		r.csv.Flush()
+		if r.err == nil {
+			r.err = r.csv.Error()
+		}
+	}
+	if err := r.w.Flush(); r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// Close flushes the recorder and closes the underlying writer.
+func (r *Recorder) Close() error {
+	err := r.Flush()
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Err returns the first error the recorder ran into, after
+// an error it stops recording.
+func (r *Recorder) Err() error {
+	return r.err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
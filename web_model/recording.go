@@ -0,0 +1,444 @@
+package web_model
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// RecordingVersion is written to every recording,
+// reading refuses recordings with a different version.
+const RecordingVersion = 1
+
+// A recording starts with the magic and the version, the rest is
+// gzip compressed: the length prefixed JSON header followed by
+// records, each one a type byte and its data, and an end record.
+// Snapshots are delta encoded against the previous snapshot, integers
+// as varint differences and floats as the XOR of their bits, which
+// is small when a value barely changed.
+const recordingMagic = "ALIFEREC"
+
+const (
+	recordEnd byte = iota
+	recordSnapshot
+	recordEvent
+)
+
+var eventKinds = []string{EventGroom, EventAggression, EventSharedEating}
+
+// RecordingHeader tells what was recorded, Params are the
+// parameters the simulation was started with.
+type RecordingHeader struct {
+	Params        json.RawMessage
+	Seed          int64
+	Width, Height int
+	VisionLength  int
+	VisionAngle   int
+	Walls         []Segment
+	Border        string
+	World         string
+}
+
+// entityCodec is an entity as the numbers that are delta encoded.
+type entityCodec struct {
+	ints   [8]int64 // id, kind, flags, rank, groom and aggression targets, owner, number of DSI partners
+	floats [9]float64
+	dsiIDs []int64
+	dsi    []float64
+}
+
+const (
+	flagAlive = 1 << iota
+	flagStressed
+	flagHidden
+	flagCollided
+)
+
+func newEntityCodec(e Entity) entityCodec {
+	var c entityCodec
+	c.ints[0] = int64(e.ID)
+	c.floats[0], c.floats[1] = e.X, e.Y
+	var flags int64
+	if a := e.Agent; a != nil {
+		if a.Alive {
+			flags |= flagAlive
+		}
+		if a.Stressed {
+			flags |= flagStressed
+		}
+		if a.Collided {
+			flags |= flagCollided
+		}
+		c.ints[3], c.ints[4], c.ints[5] = int64(a.Rank), int64(a.GroomTarget), int64(a.AggressionTarget)
+		c.floats[2], c.floats[3], c.floats[4] = a.Direction, a.Energy, a.Cortisol
+		c.floats[5], c.floats[6], c.floats[7] = a.Oxytocin, a.Socialness, a.Motivation
+		for id := range a.DSI {
+			c.dsiIDs = append(c.dsiIDs, int64(id))
+		}
+		sort.Slice(c.dsiIDs, func(i, j int) bool { return c.dsiIDs[i] < c.dsiIDs[j] })
+		for _, id := range c.dsiIDs {
+			c.dsi = append(c.dsi, a.DSI[int(id)])
+		}
+		c.ints[7] = int64(len(c.dsiIDs))
+	}
+	if f := e.Food; f != nil {
+		c.ints[1] = 1
+		if f.Hidden {
+			flags |= flagHidden
+		}
+		c.ints[6] = int64(f.Owner)
+		c.floats[8] = f.Resource
+	}
+	c.ints[2] = flags
+	return c
+}
+
+func (c entityCodec) entity() Entity {
+	e := Entity{ID: int(c.ints[0]), X: c.floats[0], Y: c.floats[1]}
+	flags := c.ints[2]
+	if c.ints[1] == 1 {
+		e.Kind = "food"
+		e.Food = &FoodSnapshot{
+			Resource: c.floats[8],
+			Hidden:   flags&flagHidden != 0,
+			Owner:    int(c.ints[6]),
+		}
+		return e
+	}
+	e.Kind = "agent"
+	e.Agent = &AgentSnapshot{
+		Direction:        c.floats[2],
+		Alive:            flags&flagAlive != 0,
+		Rank:             int(c.ints[3]),
+		Stressed:         flags&flagStressed != 0,
+		Collided:         flags&flagCollided != 0,
+		Energy:           c.floats[3],
+		Cortisol:         c.floats[4],
+		Oxytocin:         c.floats[5],
+		Socialness:       c.floats[6],
+		Motivation:       c.floats[7],
+		GroomTarget:      int(c.ints[4]),
+		AggressionTarget: int(c.ints[5]),
+		DSI:              make(map[int]float64, len(c.dsiIDs)),
+	}
+	for i, id := range c.dsiIDs {
+		e.Agent.DSI[int(id)] = c.dsi[i]
+	}
+	return e
+}
+
+// RecordingWriter writes a run in the binary recording format.
+// Record is meant to get the snapshot of every iteration and AddEvent
+// to be called by the grid, both from the engine goroutine.
+type RecordingWriter struct {
+	w         *bufio.Writer
+	gz        *gzip.Writer
+	closer    io.Closer
+	buf       [binary.MaxVarintLen64]byte
+	iteration int
+	season    int
+	previous  []entityCodec
+	err       error
+}
+
+// NewRecordingWriter writes the header to w. If w is an io.Closer,
+// Close closes it.
+func NewRecordingWriter(w io.Writer, header RecordingHeader) (*RecordingWriter, error) {
+	if _, err := io.WriteString(w, recordingMagic); err != nil {
+		return nil, err
+	}
+	r := &RecordingWriter{}
+	if _, err := w.Write(r.buf[:binary.PutUvarint(r.buf[:], RecordingVersion)]); err != nil {
+		return nil, err
+	}
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	r.gz = gzip.NewWriter(w)
+	r.w = bufio.NewWriter(r.gz)
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	r.uvarint(uint64(len(data)))
+	r.write(data)
+	return r, r.err
+}
+
+func (r *RecordingWriter) write(data []byte) {
+	if r.err == nil {
+		_, r.err = r.w.Write(data)
+	}
+}
+
+func (r *RecordingWriter) uvarint(x uint64) {
+	r.write(r.buf[:binary.PutUvarint(r.buf[:], x)])
+}
+
+func (r *RecordingWriter) varint(x int64) {
+	r.write(r.buf[:binary.PutVarint(r.buf[:], x)])
+}
+
+func (r *RecordingWriter) float(f, previous float64) {
+	r.uvarint(math.Float64bits(f) ^ math.Float64bits(previous))
+}
+
+// Record writes s as the difference to the snapshot recorded before.
+func (r *RecordingWriter) Record(s *Snapshot) {
+	r.write([]byte{recordSnapshot})
+	r.varint(int64(s.Iteration - r.iteration))
+	r.iteration = s.Iteration
+	r.varint(int64(s.Season - r.season))
+	r.season = s.Season
+	r.uvarint(uint64(len(s.Entities)))
+	current := make([]entityCodec, len(s.Entities))
+	for i, e := range s.Entities {
+		var previous entityCodec
+		if i < len(r.previous) {
+			previous = r.previous[i]
+		}
+		c := newEntityCodec(e)
+		for j, n := range c.ints {
+			r.varint(n - previous.ints[j])
+		}
+		for j, f := range c.floats {
+			r.float(f, previous.floats[j])
+		}
+		for j := range c.dsiIDs {
+			var id int64
+			var dsi float64
+			if j < len(previous.dsiIDs) {
+				id, dsi = previous.dsiIDs[j], previous.dsi[j]
+			}
+			r.varint(c.dsiIDs[j] - id)
+			r.float(c.dsi[j], dsi)
+		}
+		current[i] = c
+	}
+	r.previous = current
+}
+
+func (r *RecordingWriter) AddEvent(e Event) {
+	kind := 0
+	for i, k := range eventKinds {
+		if k == e.Kind {
+			kind = i
+		}
+	}
+	r.write([]byte{recordEvent, byte(kind)})
+	r.varint(int64(e.Tick))
+	r.varint(int64(e.Actor))
+	r.varint(int64(e.Target))
+	for _, f := range []float64{e.Intensity, e.ActorDelta.Cortisol, e.ActorDelta.Oxytocin, e.ActorDelta.DSI,
+		e.TargetDelta.Cortisol, e.TargetDelta.Oxytocin, e.TargetDelta.DSI} {
+		r.float(f, 0)
+	}
+}
+
+// Close ends the recording and closes the underlying writer.
+func (r *RecordingWriter) Close() error {
+	r.write([]byte{recordEnd})
+	if err := r.w.Flush(); r.err == nil {
+		r.err = err
+	}
+	if err := r.gz.Close(); r.err == nil {
+		r.err = err
+	}
+	err := r.err
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// RecordingReader reads a recording written by RecordingWriter.
+type RecordingReader struct {
+	r         *bufio.Reader
+	gz        *gzip.Reader
+	header    RecordingHeader
+	iteration int
+	season    int
+	previous  []entityCodec
+}
+
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordingMagic {
+		return nil, errors.New("not a recording")
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if version != RecordingVersion {
+		return nil, fmt.Errorf("recording version %d, expected %d", version, RecordingVersion)
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	rr := &RecordingReader{r: bufio.NewReader(gz), gz: gz}
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, data); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &rr.header); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+func (r *RecordingReader) Header() RecordingHeader {
+	return r.header
+}
+
+// Next returns the next snapshot with the events that happened in
+// its iteration. It returns io.EOF after the last snapshot.
+func (r *RecordingReader) Next() (*Snapshot, []Event, error) {
+	var events []Event
+	for {
+		kind, err := r.r.ReadByte()
+		if err != nil {
+			return nil, nil, unexpected(err)
+		}
+		switch kind {
+		case recordEnd:
+			return nil, nil, io.EOF
+		case recordEvent:
+			e, err := r.event()
+			if err != nil {
+				return nil, nil, unexpected(err)
+			}
+			events = append(events, e)
+		case recordSnapshot:
+			s, err := r.snapshot()
+			if err != nil {
+				return nil, nil, unexpected(err)
+			}
+			return s, events, nil
+		default:
+			return nil, nil, fmt.Errorf("invalid record type %d", kind)
+		}
+	}
+}
+
+// unexpected turns the end of the data before the end record into
+// an error, the recording was cut off.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *RecordingReader) float(previous float64) (float64, error) {
+	bits, err := binary.ReadUvarint(r.r)
+	return math.Float64frombits(bits ^ math.Float64bits(previous)), err
+}
+
+func (r *RecordingReader) snapshot() (*Snapshot, error) {
+	delta, err := binary.ReadVarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	r.iteration += int(delta)
+	if delta, err = binary.ReadVarint(r.r); err != nil {
+		return nil, err
+	}
+	r.season += int(delta)
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	h := r.header
+	s := &Snapshot{Iteration: r.iteration, Width: h.Width, Height: h.Height,
+		VisionLength: h.VisionLength, VisionAngle: h.VisionAngle, Walls: h.Walls,
+		Border: h.Border, World: h.World, Season: r.season}
+	current := make([]entityCodec, n)
+	for i := range current {
+		var previous entityCodec
+		if i < len(r.previous) {
+			previous = r.previous[i]
+		}
+		c := &current[i]
+		for j := range c.ints {
+			d, err := binary.ReadVarint(r.r)
+			if err != nil {
+				return nil, err
+			}
+			c.ints[j] = previous.ints[j] + d
+		}
+		for j := range c.floats {
+			if c.floats[j], err = r.float(previous.floats[j]); err != nil {
+				return nil, err
+			}
+		}
+		if c.ints[7] < 0 || c.ints[7] > int64(n) {
+			return nil, errors.New("invalid number of DSI partners")
+		}
+		c.dsiIDs = make([]int64, c.ints[7])
+		c.dsi = make([]float64, c.ints[7])
+		for j := range c.dsiIDs {
+			var id int64
+			var dsi float64
+			if j < len(previous.dsiIDs) {
+				id, dsi = previous.dsiIDs[j], previous.dsi[j]
+			}
+			d, err := binary.ReadVarint(r.r)
+			if err != nil {
+				return nil, err
+			}
+			c.dsiIDs[j] = id + d
+			if c.dsi[j], err = r.float(dsi); err != nil {
+				return nil, err
+			}
+		}
+		s.Entities = append(s.Entities, c.entity())
+	}
+	r.previous = current
+	return s, nil
+}
+
+func (r *RecordingReader) event() (Event, error) {
+	var e Event
+	kind, err := r.r.ReadByte()
+	if err != nil {
+		return e, err
+	}
+	if int(kind) >= len(eventKinds) {
+		return e, fmt.Errorf("invalid event kind %d", kind)
+	}
+	e.Kind = eventKinds[kind]
+	for _, n := range []*int{&e.Tick, &e.Actor, &e.Target} {
+		v, err := binary.ReadVarint(r.r)
+		if err != nil {
+			return e, err
+		}
+		*n = int(v)
+	}
+	for _, f := range []*float64{&e.Intensity, &e.ActorDelta.Cortisol, &e.ActorDelta.Oxytocin, &e.ActorDelta.DSI,
+		&e.TargetDelta.Cortisol, &e.TargetDelta.Oxytocin, &e.TargetDelta.DSI} {
+		if *f, err = r.float(0); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// Close releases the decompressor, it does not close the underlying reader.
+func (r *RecordingReader) Close() error {
+	return r.gz.Close()
+}
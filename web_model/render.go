@@ -0,0 +1,211 @@
+package web_model
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// RenderOptions change how Render draws a snapshot.
+type RenderOptions struct {
+	Scale       int    // pixels per grid unit, 5 if not set
+	ColorBy     string // rank (default) or stress
+	VisionCones bool
+}
+
+var (
+	backgroundColor = color.RGBA{0x2b, 0x28, 0x28, 0xff}
+	wallColor       = color.RGBA{0xc8, 0xc8, 0xc8, 0xff}
+	foodColor       = color.RGBA{0xff, 0xd7, 0x00, 0xff}
+	hiddenColor     = color.RGBA{0x60, 0x60, 0x60, 0xff}
+	deadColor       = color.RGBA{0x80, 0x80, 0x80, 0xff}
+	stressedColor   = color.RGBA{0xff, 0x30, 0x30, 0xff}
+	calmColor       = color.RGBA{0x30, 0xd0, 0x60, 0xff}
+	visionColor     = color.RGBA{0xff, 0xff, 0xff, 0x30}
+	// the same colors as the web viewer, by rank
+	rankColors = []color.RGBA{
+		{0xff, 0xff, 0xff, 0xff}, {0xff, 0x00, 0x00, 0xff}, {0x00, 0x00, 0xff, 0xff}, {0x00, 0x80, 0x00, 0xff},
+		{0xee, 0x82, 0xee, 0xff}, {0xff, 0xa5, 0x00, 0xff}, {0x00, 0xff, 0xff, 0xff},
+	}
+)
+
+// CheckRenderOptions tells what is wrong with o.
+func CheckRenderOptions(o RenderOptions) error {
+	if o.ColorBy != "" && o.ColorBy != "rank" && o.ColorBy != "stress" {
+		return errors.New("color must be one of: rank, stress")
+	}
+	if o.Scale < 0 || o.Scale > 20 {
+		return errors.New("scale must be from 1 to 20")
+	}
+	return nil
+}
+
+// Render draws s: the walls, food as squares growing with their
+// resource (grey while hidden) and agents coloured by rank or by
+// stress, dead agents grey.
+func Render(s *Snapshot, o RenderOptions) *image.RGBA {
+	scale := float64(o.Scale)
+	if o.Scale <= 0 {
+		scale = 5
+	}
+	c := &canvas{
+		img:   image.NewRGBA(image.Rect(0, 0, int(float64(s.Width)*scale), int(float64(s.Height)*scale))),
+		scale: scale,
+	}
+	c.fill(backgroundColor)
+	if o.VisionCones {
+		for _, e := range s.Entities {
+			if e.Agent != nil && e.Agent.Alive {
+				c.visionCone(e, s.VisionLength, s.VisionAngle)
+			}
+		}
+	}
+	for _, wall := range s.Walls {
+		c.line(wall.X1, wall.Y1, wall.X2, wall.Y2, 2, wallColor)
+	}
+	for _, e := range s.Entities {
+		if e.Food != nil {
+			if e.Food.Resource <= 0 {
+				continue
+			}
+			col := foodColor
+			if e.Food.Hidden {
+				col = hiddenColor
+			}
+			half := (1 + e.Food.Resource*0.5) / 2
+			c.rect(e.X-half, e.Y-half, e.X+half, e.Y+half, col)
+		}
+	}
+	for _, e := range s.Entities {
+		if e.Agent != nil {
+			c.circle(e.X, e.Y, 1, agentColor(e.Agent, o.ColorBy))
+			if e.Agent.Alive {
+				rad := e.Agent.Direction * math.Pi / 180
+				c.line(e.X, e.Y, e.X+2*math.Sin(rad), e.Y+2*math.Cos(rad), 1, agentColor(e.Agent, o.ColorBy))
+			}
+		}
+	}
+	return c.img
+}
+
+func agentColor(a *AgentSnapshot, by string) color.RGBA {
+	switch {
+	case !a.Alive:
+		return deadColor
+	case by == "stress" && a.Stressed:
+		return stressedColor
+	case by == "stress":
+		return calmColor
+	}
+	return rankColors[a.Rank%len(rankColors)]
+}
+
+// canvas draws in grid units on an image.
+type canvas struct {
+	img   *image.RGBA
+	scale float64
+}
+
+func (c *canvas) fill(col color.RGBA) {
+	b := c.img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c.img.SetRGBA(x, y, col)
+		}
+	}
+}
+
+// blend paints pixel x, y with col, its alpha makes it see-through.
+func (c *canvas) blend(x, y int, col color.RGBA) {
+	if !(image.Point{x, y}.In(c.img.Bounds())) {
+		return
+	}
+	if col.A == 0xff {
+		c.img.SetRGBA(x, y, col)
+		return
+	}
+	old := c.img.RGBAAt(x, y)
+	a := uint32(col.A)
+	mix := func(n, o uint8) uint8 {
+		return uint8((uint32(n)*a + uint32(o)*(0xff-a)) / 0xff)
+	}
+	c.img.SetRGBA(x, y, color.RGBA{mix(col.R, old.R), mix(col.G, old.G), mix(col.B, old.B), 0xff})
+}
+
+func (c *canvas) rect(x1, y1, x2, y2 float64, col color.RGBA) {
+	for y := int(y1 * c.scale); y < int(math.Ceil(y2*c.scale)); y++ {
+		for x := int(x1 * c.scale); x < int(math.Ceil(x2*c.scale)); x++ {
+			c.blend(x, y, col)
+		}
+	}
+}
+
+func (c *canvas) circle(cx, cy, r float64, col color.RGBA) {
+	px, py, pr := cx*c.scale, cy*c.scale, r*c.scale
+	for y := int(py - pr); y <= int(py+pr); y++ {
+		for x := int(px - pr); x <= int(px+pr); x++ {
+			dx, dy := float64(x)+0.5-px, float64(y)+0.5-py
+			if dx*dx+dy*dy <= pr*pr {
+				c.blend(x, y, col)
+			}
+		}
+	}
+}
+
+// line draws a line width pixels wide.
+func (c *canvas) line(x1, y1, x2, y2 float64, width int, col color.RGBA) {
+	px1, py1, px2, py2 := x1*c.scale, y1*c.scale, x2*c.scale, y2*c.scale
+	steps := int(math.Max(math.Abs(px2-px1), math.Abs(py2-py1))) + 1
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		x, y := int(px1+(px2-px1)*t), int(py1+(py2-py1)*t)
+		for dy := 0; dy < width; dy++ {
+			for dx := 0; dx < width; dx++ {
+				c.blend(x+dx-width/2, y+dy-width/2, col)
+			}
+		}
+	}
+}
+
+// polygon fills the polygon with corners xs, ys in grid units.
+func (c *canvas) polygon(xs, ys []float64, col color.RGBA) {
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, y := range ys {
+		minY, maxY = math.Min(minY, y*c.scale), math.Max(maxY, y*c.scale)
+	}
+	for y := int(minY); y <= int(maxY); y++ {
+		fy := float64(y) + 0.5
+		var crossings []float64
+		for i := range xs {
+			j := (i + 1) % len(xs)
+			y1, y2 := ys[i]*c.scale, ys[j]*c.scale
+			if (y1 <= fy) != (y2 <= fy) {
+				x1, x2 := xs[i]*c.scale, xs[j]*c.scale
+				crossings = append(crossings, x1+(fy-y1)/(y2-y1)*(x2-x1))
+			}
+		}
+		sort.Float64s(crossings)
+		for i := 0; i+1 < len(crossings); i += 2 {
+			for x := int(crossings[i] + 0.5); x < int(crossings[i+1]+0.5); x++ {
+				c.blend(x, y, col)
+			}
+		}
+	}
+}
+
+// visionCone fills what an agent sees, the arc between the edges
+// of its vision is approximated every few degrees.
+func (c *canvas) visionCone(e Entity, length, angle int) {
+	xs, ys := []float64{e.X}, []float64{e.Y}
+	for a := angle; a > 0; a -= 5 {
+		left := visionVectors(e.Agent.Direction, length, a).leftVector
+		xs, ys = append(xs, e.X+left.x), append(ys, e.Y+left.y)
+	}
+	for a := 0; a <= angle; a += 5 {
+		right := visionVectors(e.Agent.Direction, length, a).rightVector
+		xs, ys = append(xs, e.X+right.x), append(ys, e.Y+right.y)
+	}
+	c.polygon(xs, ys, visionColor)
+}
@@ -0,0 +1,135 @@
+package web_model
+
+import "github.com/Kubiuks/Alife_web/web_lib"
+
+// Snapshot is a copy of the state of a simulation between two
+// iterations. It shares nothing with the running model, so it can be
+// handed to other goroutines; it must not be modified.
+type Snapshot struct {
+	Iteration     int // the iteration just run, -1 before the first one
+	Width, Height int
+	VisionLength  int
+	VisionAngle   int // to either side of the direction
+	Walls         []Segment
+	Border        string   // periodic or aperiodic
+	World         string   // the world dynamics
+	Season        int      // of the world dynamics
+	Entities      []Entity // in the order the ABM runs them
+}
+
+// Segment is a straight wall from X1, Y1 to X2, Y2.
+type Segment struct {
+	X1, Y1, X2, Y2 float64
+}
+
+// Entity is an agent or a food source, Kind tells which
+// of Agent and Food is set.
+type Entity struct {
+	ID    int
+	Kind  string
+	X, Y  float64
+	Agent *AgentSnapshot `json:",omitempty"`
+	Food  *FoodSnapshot  `json:",omitempty"`
+}
+
+// GroomTarget and AggressionTarget are the agents groomed
+// or attacked this iteration, 0 if none. Collided tells whether
+// the agent ran into a wall this iteration.
+type AgentSnapshot struct {
+	Direction        float64
+	Alive            bool
+	Rank             int
+	Stressed         bool
+	Collided         bool
+	Energy           float64
+	Cortisol         float64
+	Oxytocin         float64
+	Socialness       float64
+	Motivation       float64
+	GroomTarget      int
+	AggressionTarget int
+	DSI              map[int]float64 // DSI strength by bond partner id
+}
+
+// Owner is the agent that took the food, 0 if none.
+type FoodSnapshot struct {
+	Resource float64
+	Hidden   bool
+	Owner    int
+}
+
+// NewSnapshot copies the state of a, which must be a simulation on
+// a Grid. It must be called between iterations, from the report
+// function or before or after StartSimulation.
+func NewSnapshot(a *web_lib.ABM) *Snapshot {
+	s := &Snapshot{Iteration: a.Ticks() - 1}
+	if grid, ok := a.World().(*Grid); ok {
+		s.Width, s.Height = grid.width, grid.height
+		s.VisionLength, s.VisionAngle = grid.visionLength, grid.visionAngle
+		s.Walls = grid.wallSegments()
+		s.Border = grid.border.String()
+		if grid.dynamics != nil {
+			s.World = grid.dynamics.String()
+			s.Season = grid.dynamics.Season()
+		}
+	}
+	agents := a.Agents()
+	s.Entities = make([]Entity, 0, len(agents))
+	for _, agent := range agents {
+		switch e := agent.(type) {
+		case *Agent:
+			s.Entities = append(s.Entities, e.snapshot())
+		case *Food:
+			s.Entities = append(s.Entities, e.snapshot())
+		}
+	}
+	return s
+}
+
+func (a *Agent) snapshot() Entity {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	state := &AgentSnapshot{
+		Direction:        a.direction,
+		Alive:            a.alive,
+		Rank:             a.rank,
+		Stressed:         a.stressed,
+		Collided:         a.collided,
+		Energy:           a.energy,
+		Cortisol:         a.cortisol,
+		Oxytocin:         a.oxytocin,
+		Socialness:       a.socialness,
+		Motivation:       a.motivation,
+		GroomTarget:      a.groomedWith,
+		AggressionTarget: a.aggressionOn,
+		DSI:              make(map[int]float64, len(a.bondPartners)),
+	}
+	for i, id := range a.bondPartners {
+		state.DSI[id] = a.DSIstrengths[i]
+	}
+	return Entity{ID: a.id, Kind: "agent", X: a.x, Y: a.y, Agent: state}
+}
+
+func (f *Food) snapshot() Entity {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	state := &FoodSnapshot{
+		Resource: f.resource,
+		Hidden:   f.hidden,
+	}
+	if f.owner != nil {
+		state.Owner = f.owner.id
+	}
+	return Entity{ID: f.id, Kind: "food", X: f.x, Y: f.y, Food: state}
+}
+
+// Agents returns the agents of the snapshot.
+func (s *Snapshot) Agents() []Entity {
+	var agents []Entity
+	for _, e := range s.Entities {
+		if e.Agent != nil {
+			agents = append(agents, e)
+		}
+	}
+	return agents
+}
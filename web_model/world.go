@@ -15,13 +15,20 @@ type Grid struct {
 	visionAngle   int
 	cells         []web_lib.Agent
 	agentVision   [][]web_lib.Agent
-	walls         []directionVectors
-	worldDynamics string
+	walls         []directionVectors // the border walls first
+	interior      []Segment          // walls added inside the grid
+	obstacles     []Polygon
+	border        web_lib.BorderRule
+	collision     web_lib.CollisionRule
+	dynamics      WorldDynamics
+	access        FoodAccess
 	iteration     int
-	season        int
-	extremeSeason int
+	eventFunc     func(Event)
 }
 
+// Polygon is an obstacle, the corners in order around it.
+type Polygon [][2]float64
+
 type directionVectors struct {
 	leftVector  vector
 	rightVector vector
@@ -31,23 +38,27 @@ type vector struct {
 	x, y float64
 }
 
-func NewWorld(width, height, numberOfAgents, visionLength, visionAngle int) *Grid {
+// NewWorld creates a grid surrounded by walls, or with a periodic border
+// one without walls where whatever leaves on one side comes back on the other.
+func NewWorld(width, height, numberOfAgents, visionLength, visionAngle int, border web_lib.BorderRule) *Grid {
 	g := &Grid{
 		width:         width,
 		height:        height,
 		visionLength:  visionLength,
 		visionAngle:   visionAngle,
+		border:        border,
 		iteration:     0,
-		season:        0,
-		extremeSeason: 0,
 	}
+	g.access.Check()
 	g.cells = make([]web_lib.Agent, g.size())
 	g.agentVision = make([][]web_lib.Agent, numberOfAgents)
 	for i := 0; i < numberOfAgents; i++ {
 		g.agentVision[i] = nil
 	}
-	g.walls = make([]directionVectors, 4)
-	g.initialiseWalls(width, height)
+	if border != web_lib.BorderPeriodic {
+		g.walls = make([]directionVectors, 4)
+		g.initialiseWalls(width, height)
+	}
 	//g.testVision()
 	//g.testIntersection()
 	//g.testWalldetection()
@@ -57,7 +68,9 @@ func NewWorld(width, height, numberOfAgents, visionLength, visionAngle int) *Gri
 // Tick marks beginning of the new time period.
 // Implements World interface.
 func (g *Grid) Tick(agents []web_lib.Agent) {
-	g.updateWorld(agents)
+	if g.dynamics != nil {
+		g.dynamics.Update(g, foodSources(agents), g.iteration)
+	}
 	g.iteration++
 	g.mx.RLock()
 	defer g.mx.RUnlock()
@@ -70,143 +83,47 @@ func (g *Grid) Tick(agents []web_lib.Agent) {
 	}
 }
 
-func (g *Grid) updateWorld(agents []web_lib.Agent) {
-	if g.iteration < 2000 || (g.iteration%1000) != 0 {
-		return
-	}
-	switch g.worldDynamics {
-	case "Static":
+// SetEventFunc sets the function called for every interaction
+// between agents, it is called from the engine goroutine.
+func (g *Grid) SetEventFunc(fn func(Event)) {
+	g.eventFunc = fn
+}
+
+// emit stamps e with the iteration being run, Tick has
+// already counted it in g.iteration.
+func (g *Grid) emit(e Event) {
+	if g.eventFunc == nil {
 		return
-	case "Seasonal":
-		g.seasonalChange(agents)
-	case "Extreme":
-		g.extremeChange(agents)
 	}
+	e.Tick = g.iteration - 1
+	g.eventFunc(e)
 }
 
-func (g *Grid) seasonalChange(agents []web_lib.Agent) {
-	season := g.season % 6
-	var food *Food
-	switch season {
-	case 0:
-		food = g.foodAt(89, 89, agents)
-		if food != nil {
-			food.SetHidden(true)
-		}
-		if food != nil {
-			g.ClearCell(89, 89, -1)
-		}
-		g.season = 1
-	case 1:
-		food = g.foodAt(9, 9, agents)
-		if food != nil {
-			food.SetHidden(true)
-		}
-		if food != nil {
-			g.ClearCell(9, 9, -1)
-		}
-		g.season = 2
-	case 2:
-		food = g.foodAt(89, 9, agents)
-		if food != nil {
-			food.SetHidden(true)
-		}
-		if food != nil {
-			g.ClearCell(89, 9, -1)
-		}
-		g.season = 3
-	case 3:
-		food = g.foodAt(89, 9, agents)
-		if food != nil {
-			food.SetHidden(false)
-		}
-		if food != nil {
-			g.SetCell(89, 9, food)
-		}
-		g.season = 4
-	case 4:
-		food = g.foodAt(9, 9, agents)
-		if food != nil {
-			food.SetHidden(false)
-		}
-		if food != nil {
-			g.SetCell(9, 9, food)
-		}
-		g.season = 5
-	case 5:
-		food = g.foodAt(89, 89, agents)
-		if food != nil {
-			food.SetHidden(false)
-		}
-		if food != nil {
-			g.SetCell(89, 89, food)
+// foodSources are the food sources among agents, in the order they were placed.
+func foodSources(agents []web_lib.Agent) []*Food {
+	var foods []*Food
+	for _, agent := range agents {
+		if food, ok := agent.(*Food); ok {
+			foods = append(foods, food)
 		}
-		g.season = 0
 	}
+	return foods
 }
 
-func (g *Grid) extremeChange(agents []web_lib.Agent) {
-	extremeSeason := g.extremeSeason % 2
-	var food1, food2, food3 *Food
-	switch extremeSeason {
-	case 0:
-		food1 = g.foodAt(9, 9, agents)
-		food2 = g.foodAt(9, 89, agents)
-		food3 = g.foodAt(89, 9, agents)
-		if food1 != nil {
-			food1.SetHidden(true)
-		}
-		if food2 != nil {
-			food2.SetHidden(true)
-		}
-		if food3 != nil {
-			food3.SetHidden(true)
-		}
-		if food1 != nil {
-			g.ClearCell(9, 9, -1)
-		}
-		if food2 != nil {
-			g.ClearCell(9, 89, -1)
-		}
-		if food3 != nil {
-			g.ClearCell(89, 9, -1)
-		}
-		g.extremeSeason = 1
-	case 1:
-		food1 = g.foodAt(9, 9, agents)
-		food2 = g.foodAt(9, 89, agents)
-		food3 = g.foodAt(89, 9, agents)
-		if food1 != nil {
-			food1.SetHidden(false)
-		}
-		if food2 != nil {
-			food2.SetHidden(false)
-		}
-		if food3 != nil {
-			food3.SetHidden(false)
-		}
-		if food1 != nil {
-			g.SetCell(9, 9, food1)
-		}
-		if food2 != nil {
-			g.SetCell(9, 89, food2)
-		}
-		if food3 != nil {
-			g.SetCell(89, 9, food3)
-		}
-		g.extremeSeason = 0
+func (g *Grid) hideFood(food *Food) {
+	if food.Hidden() {
+		return
 	}
+	food.SetHidden(true)
+	g.ClearCell(food.X(), food.Y(), -1)
 }
 
-func (g *Grid) foodAt(x, y float64, agents []web_lib.Agent) *Food {
-	for _, agent := range agents {
-		if food, ok := agent.(*Food); ok {
-			if food.X() == x && food.Y() == y && food.Alive() {
-				return food
-			}
-		}
+func (g *Grid) revealFood(food *Food) {
+	if !food.Hidden() {
+		return
 	}
-	return nil
+	food.SetHidden(false)
+	g.SetCell(food.X(), food.Y(), food)
 }
 
 func (g *Grid) checkAgentVision(agents []web_lib.Agent, agent *Agent) {
@@ -217,7 +134,7 @@ func (g *Grid) checkAgentVision(agents []web_lib.Agent, agent *Agent) {
 		vision.leftVector.y + center.y}
 	rightVisionEnd := vector{vision.rightVector.x + center.x,
 		vision.rightVector.y + center.y}
-	for i := 0; i < 4; i++ {
+	for i := range g.walls {
 		if wall := g.checkWallInSigth(i, center, leftVisionEnd, rightVisionEnd); wall != nil {
 			newWall := NewWall(wall.(vector).x, wall.(vector).y)
 			g.agentVision[agent.ID()-1] = append(g.agentVision[agent.ID()-1], newWall)
@@ -232,37 +149,14 @@ func (g *Grid) checkAgentVision(agents []web_lib.Agent, agent *Agent) {
 				continue
 			}
 		}
-		point := vector{agents[k].X(), agents[k].Y()}
+		point := g.nearest(center, vector{agents[k].X(), agents[k].Y()})
 		if isInsideSector(center, point, vision.leftVector,
-			vision.rightVector, g.visionLength) {
+			vision.rightVector, g.visionLength) && !g.crossesWall(center, point) {
 			g.agentVision[agent.ID()-1] = append(g.agentVision[agent.ID()-1], agents[k])
 		}
 	}
 }
 
-func (g *Grid) checkOccupyingFood(agents []web_lib.Agent, food *Food) {
-	var highestRankAgent *Agent
-	highestRank := 0
-	center := vector{food.X(), food.Y()}
-	food.ResetEatingAgents()
-	for k := 0; k < len(agents); k++ {
-		if agents[k].ID() < 1 {
-			continue
-		}
-		point := vector{agents[k].X(), agents[k].Y()}
-		relVector := vector{point.x - center.x, point.y - center.y}
-		if isWithinRadius(relVector, 4) {
-			if agents[k].(*Agent).Rank() > highestRank {
-				highestRankAgent = agents[k].(*Agent)
-			}
-			if isWithinRadius(relVector, 1) {
-				food.AddEatingAgent(agents[k].(*Agent))
-			}
-		}
-	}
-	food.SetOwner(highestRankAgent)
-}
-
 func (g *Grid) Move(id int, fromX, fromY, toX, toY float64) error {
 	if err := g.validateXY(fromX, fromY); err != nil {
 		return err
@@ -270,6 +164,9 @@ func (g *Grid) Move(id int, fromX, fromY, toX, toY float64) error {
 	if err := g.validateXY(toX, toY); err != nil {
 		return err
 	}
+	if g.Blocked(fromX, fromY, toX, toY) {
+		return errors.New("move blocked by a wall")
+	}
 	g.mx.Lock()
 	defer g.mx.Unlock()
 	indexFrom := g.idx(fromX, fromY)
@@ -315,6 +212,9 @@ func (g *Grid) Copy(id int, fromX, fromY, toX, toY float64) error {
 	if err := g.validateXY(toX, toY); err != nil {
 		return err
 	}
+	if g.Blocked(fromX, fromY, toX, toY) {
+		return errors.New("move blocked by a wall")
+	}
 	g.mx.Lock()
 	defer g.mx.Unlock()
 	indexFrom := g.idx(fromX, fromY)
@@ -403,7 +303,223 @@ func (g *Grid) Height() int {
 	return g.height
 }
 
+// AddWall adds a wall inside the grid from x1, y1 to x2, y2. Walls
+// block movement and sight, agents see them like the border walls.
+// Walls must be added before the simulation starts.
+func (g *Grid) AddWall(x1, y1, x2, y2 float64) error {
+	if err := g.checkWall(x1, y1, x2, y2); err != nil {
+		return err
+	}
+	g.interior = append(g.interior, Segment{x1, y1, x2, y2})
+	g.walls = append(g.walls, directionVectors{vector{x1, y1}, vector{x2, y2}})
+	return nil
+}
+
+// AddObstacle adds a polygon surrounded by walls, nothing
+// can be inside it. It must be added before the simulation starts.
+func (g *Grid) AddObstacle(p Polygon) error {
+	if len(p) < 3 {
+		return errors.New("obstacle needs at least 3 corners")
+	}
+	for i := range p {
+		next := p[(i+1)%len(p)]
+		if err := g.checkWall(p[i][0], p[i][1], next[0], next[1]); err != nil {
+			return err
+		}
+	}
+	// the walls of the obstacle are part of it, not of interior
+	for i := range p {
+		next := p[(i+1)%len(p)]
+		g.walls = append(g.walls, directionVectors{vector{p[i][0], p[i][1]}, vector{next[0], next[1]}})
+	}
+	g.obstacles = append(g.obstacles, p)
+	return nil
+}
+
+func (g *Grid) checkWall(x1, y1, x2, y2 float64) error {
+	for _, p := range [][2]float64{{x1, y1}, {x2, y2}} {
+		if p[0] < 0 || p[0] > float64(g.width) || p[1] < 0 || p[1] > float64(g.height) {
+			return errors.New("wall outside the grid")
+		}
+	}
+	if x1 == x2 && y1 == y2 {
+		return errors.New("wall has no length")
+	}
+	return nil
+}
+
+// SetCollisionRule decides what happens to moves into a wall,
+// by default they are rejected.
+func (g *Grid) SetCollisionRule(rule web_lib.CollisionRule) {
+	g.collision = rule
+}
+
+func (g *Grid) CollisionRule() web_lib.CollisionRule {
+	return g.collision
+}
+
+// wallGap keeps a deflected move just off the wall it hit.
+const wallGap = 1e-6
+
+// deflect turns a move from fromX, fromY to toX, toY that runs into a
+// wall into a reflected or sliding one according to the collision rule,
+// together with the direction the agent heads afterwards. It fails if
+// the move is rejected or cannot be deflected, at a corner for example.
+func (g *Grid) deflect(fromX, fromY, toX, toY, direction float64) (float64, float64, float64, bool) {
+	if g.collision == web_lib.CollisionReject {
+		return fromX, fromY, direction, false
+	}
+	start := vector{fromX, fromY}
+	end := g.nearest(start, vector{toX, toY})
+	for bounces := 0; bounces < 3; bounces++ {
+		hit, wall, ok := g.firstWall(start, end)
+		if !ok {
+			break
+		}
+		move := vector{end.x - start.x, end.y - start.y}
+		length := math.Hypot(move.x, move.y)
+		along := vector{wall.rightVector.x - wall.leftVector.x, wall.rightVector.y - wall.leftVector.y}
+		wallLength := math.Hypot(along.x, along.y)
+		along = vector{along.x / wallLength, along.y / wallLength}
+		rest := vector{end.x - hit.x, end.y - hit.y}
+		restAlong := rest.x*along.x + rest.y*along.y
+		if g.collision == web_lib.CollisionReflect {
+			// mirror the rest of the move and the heading at the wall
+			rest = vector{2*restAlong*along.x - rest.x, 2*restAlong*along.y - rest.y}
+			heading := vector{math.Sin(direction * (math.Pi / 180.0)), math.Cos(direction * (math.Pi / 180.0))}
+			headingAlong := heading.x*along.x + heading.y*along.y
+			heading = vector{2*headingAlong*along.x - heading.x, 2*headingAlong*along.y - heading.y}
+			direction = mod(math.Atan2(heading.x, heading.y)*(180.0/math.Pi), 360)
+		} else {
+			rest = vector{restAlong * along.x, restAlong * along.y}
+		}
+		start = vector{hit.x - move.x/length*wallGap, hit.y - move.y/length*wallGap}
+		end = vector{start.x + rest.x, start.y + rest.y}
+	}
+	x, y := g.wrap(end.x, end.y)
+	if g.validateXY(x, y) != nil || g.Blocked(fromX, fromY, x, y) {
+		return fromX, fromY, direction, false
+	}
+	return x, y, direction, true
+}
+
+// firstWall returns the wall the line from p to q hits
+// first and where, if it hits any.
+func (g *Grid) firstWall(p, q vector) (vector, directionVectors, bool) {
+	var hit vector
+	var first directionVectors
+	found := false
+	for _, wall := range g.walls {
+		point := findIntersection(p, q, wall.leftVector, wall.rightVector)
+		if point == nil {
+			continue
+		}
+		v := point.(vector)
+		if !found || distance(p.x, p.y, v.x, v.y) < distance(p.x, p.y, hit.x, hit.y) {
+			hit, first, found = v, wall, true
+		}
+	}
+	return hit, first, found
+}
+
+// borderWalls is the number of walls around the grid,
+// they come before the walls added inside it.
+func (g *Grid) borderWalls() int {
+	if g.border == web_lib.BorderPeriodic {
+		return 0
+	}
+	return 4
+}
+
+// Inside tells whether x, y is inside an obstacle.
+func (g *Grid) Inside(x, y float64) bool {
+	for _, p := range g.obstacles {
+		if p.contains(x, y) {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocked tells whether a wall is in the way of a straight
+// move from fromX, fromY to toX, toY.
+func (g *Grid) Blocked(fromX, fromY, toX, toY float64) bool {
+	from, to := vector{fromX, fromY}, vector{toX, toY}
+	// a move across a periodic border is checked on both sides
+	return g.crossesWall(from, g.nearest(from, to)) || g.crossesWall(g.nearest(to, from), to)
+}
+
+// crossesWall tells whether the line from p to q crosses a wall.
+func (g *Grid) crossesWall(p, q vector) bool {
+	for _, wall := range g.walls {
+		if findIntersection(p, q, wall.leftVector, wall.rightVector) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// contains is the even-odd rule, a ray to the right of x, y
+// crosses the edges of the polygon an odd number of times.
+func (p Polygon) contains(x, y float64) bool {
+	inside := false
+	for i := range p {
+		a, b := p[i], p[(i+1)%len(p)]
+		if (a[1] > y) != (b[1] > y) && x < a[0]+(y-a[1])*(b[0]-a[0])/(b[1]-a[1]) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Border tells what happens at the edge of the grid.
+func (g *Grid) Border() web_lib.BorderRule {
+	return g.border
+}
+
+// wrap brings a position that left a periodic grid back in from the
+// other side, other positions are returned unchanged.
+func (g *Grid) wrap(x, y float64) (float64, float64) {
+	if g.border != web_lib.BorderPeriodic {
+		return x, y
+	}
+	x, y = mod(x, float64(g.width)), mod(y, float64(g.height))
+	// mod of a tiny negative number rounds up to the size
+	if x >= float64(g.width) {
+		x = 0
+	}
+	if y >= float64(g.height) {
+		y = 0
+	}
+	return x, y
+}
+
+// nearest returns the copy of point closest to center, on a periodic
+// grid that may be one on the other side of the border.
+func (g *Grid) nearest(center, point vector) vector {
+	if g.border != web_lib.BorderPeriodic {
+		return point
+	}
+	w, h := float64(g.width), float64(g.height)
+	point.x = center.x + mod(point.x-center.x+w/2, w) - w/2
+	point.y = center.y + mod(point.y-center.y+h/2, h) - h/2
+	return point
+}
+
+// distance is the shortest distance between two positions,
+// across the border of a periodic grid.
+func (g *Grid) distance(x1, y1, x2, y2 float64) float64 {
+	p := g.nearest(vector{x1, y1}, vector{x2, y2})
+	return distance(x1, y1, p.x, p.y)
+}
+
 func (g *Grid) validateXY(x, y float64) error {
+	if g.border == web_lib.BorderPeriodic {
+		if x < 0 || x >= float64(g.width) || y < 0 || y >= float64(g.height) {
+			return errors.New("position outside the periodic grid")
+		}
+		return nil
+	}
 	if x <= 0 {
 		return errors.New("x <= 0")
 	}
@@ -421,7 +537,7 @@ func (g *Grid) validateXY(x, y float64) error {
 
 func isInsideSector(center, point, sectorLeft, sectorRight vector, radius int) bool {
 	relVector := vector{point.x - center.x, point.y - center.y}
-	return isWithinRadius(relVector, radius) &&
+	return isWithinRadius(relVector, float64(radius)) &&
 		!areClockwise(sectorRight, relVector) &&
 		areClockwise(sectorLeft, relVector)
 }
@@ -429,8 +545,8 @@ func isInsideSector(center, point, sectorLeft, sectorRight vector, radius int) b
 func areClockwise(v1, v2 vector) bool {
 	return -v1.y*v2.x+v1.x*v2.y > 0
 }
-func isWithinRadius(v vector, radius int) bool {
-	return v.x*v.x+v.y*v.y <= math.Pow(float64(radius), 2)
+func isWithinRadius(v vector, radius float64) bool {
+	return v.x*v.x+v.y*v.y <= math.Pow(radius, 2)
 }
 
 func (g *Grid) checkWallInSigth(wallId int, center, leftVisionEnd, rightVisionEnd vector) interface{} {
@@ -445,6 +561,13 @@ func (g *Grid) checkWallInSigth(wallId int, center, leftVisionEnd, rightVisionEn
 	} else if rightIntersection != nil {
 		return pointOnWallWithlowestDistance(center, wallStart, rightIntersection.(vector), g.visionLength)
 	}
+	// a short wall inside the grid may be seen without crossing the edges of the vision
+	left := vector{leftVisionEnd.x - center.x, leftVisionEnd.y - center.y}
+	right := vector{rightVisionEnd.x - center.x, rightVisionEnd.y - center.y}
+	if wallId >= g.borderWalls() && (isInsideSector(center, wallStart, left, right, g.visionLength) ||
+		isInsideSector(center, wallEnd, left, right, g.visionLength)) {
+		return pointOnWallWithlowestDistance(center, wallStart, wallEnd, g.visionLength)
+	}
 	return nil
 }
 
@@ -517,17 +640,46 @@ func (g *Grid) initialiseWalls(width, height int) {
 	g.walls[3].rightVector = vector{0, float64(height)}
 }
 
+// wallSegments are all walls that block movement and sight as segments:
+// the border, none on a periodic grid, the walls inside and the edges
+// of obstacles.
+func (g *Grid) wallSegments() []Segment {
+	segments := make([]Segment, len(g.walls))
+	for i, wall := range g.walls {
+		segments[i] = Segment{wall.leftVector.x, wall.leftVector.y, wall.rightVector.x, wall.rightVector.y}
+	}
+	return segments
+}
+
 func (g *Grid) findVsionVectors(direction float64, visionLength, visionAngle int) directionVectors {
+	return visionVectors(direction, visionLength, visionAngle)
+}
+
+// visionVectors are the left and right edges of the vision cone,
+// relative to the position of the agent.
+func visionVectors(direction float64, visionLength, visionAngle int) directionVectors {
 	return directionVectors{leftVector: vector{float64(visionLength) * math.Sin((direction+(float64(visionAngle)+0.00001))*(math.Pi/180.0)),
 		float64(visionLength) * math.Cos((direction+(float64(visionAngle)+0.00001))*(math.Pi/180.0))},
 		rightVector: vector{float64(visionLength) * math.Sin((direction-(float64(visionAngle)+0.00001))*(math.Pi/180.0)),
 			float64(visionLength) * math.Cos((direction-(float64(visionAngle)+0.00001))*(math.Pi/180.0))}}
 }
 
+// SetWorldDynamics picks one of the preset dynamics by name.
 func (g *Grid) SetWorldDynamics(condition string) error {
-	if condition == "Static" || condition == "Seasonal" || condition == "Extreme" {
-		g.worldDynamics = condition
-		return nil
+	preset, err := Preset(condition)
+	if err != nil {
+		return err
 	}
-	return errors.New("season must be one of: Static, Seasonal or Extreme")
+	g.dynamics = preset
+	return nil
+}
+
+// SetDynamics sets what changes the world over time,
+// it must be called before the simulation starts.
+func (g *Grid) SetDynamics(d WorldDynamics) {
+	g.dynamics = d
+}
+
+func (g *Grid) Dynamics() WorldDynamics {
+	return g.dynamics
 }
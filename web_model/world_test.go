@@ -0,0 +1,62 @@
+package web_model
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Kubiuks/Alife_web/web_lib"
+)
+
+func TestAddObstacleInvalid(t *testing.T) {
+	g := NewWorld(100, 100, 1, 20, 160, web_lib.BorderAPeriodic)
+	// the last edge ends outside the grid
+	if err := g.AddObstacle(Polygon{{10, 10}, {20, 10}, {120, 20}}); err == nil {
+		t.Fatal("obstacle outside the grid added")
+	}
+	if len(g.walls) != 4 || len(g.interior) != 0 || len(g.obstacles) != 0 {
+		t.Fatalf("failed obstacle left %d walls, %d interior, %d obstacles", len(g.walls), len(g.interior), len(g.obstacles))
+	}
+	if err := g.AddObstacle(Polygon{{10, 10}, {20, 10}, {20, 20}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.walls) != 7 || len(g.interior) != 0 || !g.Inside(18, 12) {
+		t.Fatalf("obstacle has %d walls, %d interior", len(g.walls)-4, len(g.interior))
+	}
+}
+
+func TestMoveThroughWall(t *testing.T) {
+	g := NewWorld(100, 100, 1, 20, 160, web_lib.BorderAPeriodic)
+	if err := g.AddWall(50, 0, 50, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Move(1, 49, 10, 51, 10); err == nil {
+		t.Error("move through a wall")
+	}
+	if err := g.Copy(1, 49, 10, 51, 10); err == nil {
+		t.Error("trail through a wall")
+	}
+}
+
+func TestPeriodicGrid(t *testing.T) {
+	g := NewWorld(100, 100, 1, 20, 160, web_lib.BorderPeriodic)
+	if len(g.walls) != 0 {
+		t.Fatalf("periodic grid has %d walls", len(g.walls))
+	}
+	for _, tc := range [][4]float64{{-1, 101, 99, 1}, {100, 50, 0, 50}, {-1e-17, 3, 0, 3}, {250.5, -0.5, 50.5, 99.5}} {
+		if x, y := g.wrap(tc[0], tc[1]); x != tc[2] || y != tc[3] {
+			t.Errorf("%v,%v wrapped to %v,%v, want %v,%v", tc[0], tc[1], x, y, tc[2], tc[3])
+		}
+	}
+	if d := g.distance(1, 1, 99, 99); math.Abs(d-math.Sqrt(8)) > 1e-9 {
+		t.Errorf("distance across the corner %v, want %v", d, math.Sqrt(8))
+	}
+	if p := g.nearest(vector{1, 50}, vector{98, 50}); p.x != -2 || p.y != 50 {
+		t.Errorf("nearest copy at %v", p)
+	}
+	if err := g.validateXY(0, 0); err != nil {
+		t.Error(err)
+	}
+	if err := g.validateXY(100, 0); err == nil {
+		t.Error("x = width is on the grid")
+	}
+}